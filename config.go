@@ -0,0 +1,323 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+// Configuration file and environment support.
+//
+// Every command line option may be set in a JSON configuration file using
+// the name of the option as key, e.g.
+//
+//	{
+//	    "address": "/var/run/sysdbd.sock",
+//	    "listen": ":8080",
+//	    "snapshot-interval": "30m"
+//	}
+//
+// or in a TOML configuration file with the extension ".toml", e.g.
+//
+//	address = "/var/run/sysdbd.sock"
+//	listen = ":8080"
+//	snapshot-interval = "30m"
+//
+// or in the environment using the upper-case name of the option with dashes
+// replaced by underscores and prefixed by SYSDBWEBUI_, e.g.
+// SYSDBWEBUI_SNAPSHOT_INTERVAL=30m. Options specified on the command line
+// take precedence over the environment which takes precedence over the
+// configuration file.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sysdb/webui/server"
+)
+
+const envPrefix = "SYSDBWEBUI_"
+
+var (
+	configFile  = flag.String("config", "", "configuration file (JSON, or TOML if named *.toml)")
+	checkConfig = flag.Bool("check-config", false, "validate the configuration and exit")
+)
+
+// Options which may only be specified on the command line.
+var cmdlineOnly = map[string]bool{
+	"config":       true,
+	"check-config": true,
+}
+
+// loadConfig applies the configuration file and the environment to all
+// options not specified on the command line. It may be called repeatedly to
+// pick up changes; options removed from the configuration file are reset to
+// their default values.
+func loadConfig() error {
+	cmdline := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { cmdline[f.Name] = true })
+
+	var file map[string]string
+	if *configFile != "" {
+		var err error
+		if file, err = readConfig(*configFile); err != nil {
+			return err
+		}
+	}
+
+	var errs []string
+	flag.VisitAll(func(f *flag.Flag) {
+		if cmdline[f.Name] || cmdlineOnly[f.Name] {
+			return
+		}
+		source, value := "", f.DefValue
+		if v, ok := file[f.Name]; ok {
+			source, value = *configFile, v
+		}
+		if v, ok := os.LookupEnv(envName(f.Name)); ok {
+			source, value = envName(f.Name), v
+		}
+		if err := f.Value.Set(value); err != nil && source != "" {
+			errs = append(errs, fmt.Sprintf("%s: invalid value %q for %s: %v",
+				source, value, f.Name, err))
+		}
+	})
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+func envName(option string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(option, "-", "_", -1))
+}
+
+// readConfig reads a configuration file and returns the string
+// representation of all options. Files with the extension ".toml" are read
+// as TOML files, all other files as JSON files.
+func readConfig(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var opts map[string]string
+	if filepath.Ext(path) == ".toml" {
+		opts, err = parseTOML(data)
+		var terr *tomlError
+		if errors.As(err, &terr) {
+			line, col := position(data, int64(terr.offset)+1)
+			return nil, fmt.Errorf("%s:%d:%d: %v", path, line, col, err)
+		}
+	} else {
+		opts, err = readJSON(path, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(opts))
+	for name := range opts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []string
+	for _, name := range names {
+		if flag.Lookup(name) == nil || cmdlineOnly[name] {
+			errs = append(errs, fmt.Sprintf("%s: unknown option %q", path, name))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "\n"))
+	}
+	return opts, nil
+}
+
+// readJSON parses a JSON configuration file and returns the string
+// representation of all values.
+func readJSON(path string, data []byte) (map[string]string, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		var serr *json.SyntaxError
+		if errors.As(err, &serr) {
+			line, col := position(data, serr.Offset)
+			return nil, fmt.Errorf("%s:%d:%d: %v", path, line, col, err)
+		}
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	names := make([]string, 0, len(raw))
+	for name := range raw {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	opts := make(map[string]string, len(raw))
+	var errs []string
+	for _, name := range names {
+		v, err := optionValue(raw[name])
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: invalid value for %s: %v", path, name, err))
+			continue
+		}
+		opts[name] = v
+	}
+	if len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "\n"))
+	}
+	return opts, nil
+}
+
+// optionValue returns the command line representation of a JSON value.
+// Lists are turned into comma-separated values.
+func optionValue(raw json.RawMessage) (string, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return "", err
+	}
+
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return fmt.Sprint(v), nil
+	case json.Number:
+		return v.String(), nil
+	case []interface{}:
+		var list []string
+		for _, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return "", fmt.Errorf("expected list of strings, got %T element", e)
+			}
+			list = append(list, s)
+		}
+		return strings.Join(list, ","), nil
+	}
+	return "", fmt.Errorf("expected string, number, boolean, or list; got %s", raw)
+}
+
+// position determines the line and column of the character preceding the
+// specified offset, i.e. the last character read by the JSON decoder.
+func position(data []byte, offset int64) (line, col int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	if offset > 0 {
+		offset--
+	}
+	before := data[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	col = int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
+
+// validate checks the consistency of all options.
+func validate() error {
+	var errs []string
+	check := func(ok bool, format string, a ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, a...))
+		}
+	}
+
+	check(*addr != "" || *instances != "", "address: SysDB address must not be empty")
+	check(!*federated || *instances != "", "federated: requires instances")
+	check(len(listenAddrs()) > 0, "listen: no address specified")
+	for _, a := range listenAddrs() {
+		if a == "systemd" {
+			continue
+		}
+		if strings.HasPrefix(a, "unix:") {
+			check(a != "unix:", "listen: missing socket path in %q", a)
+			continue
+		}
+		_, _, err := net.SplitHostPort(a)
+		check(err == nil, "listen: invalid address %q: %v", a, err)
+	}
+	if *listenMode != "" {
+		_, err := strconv.ParseUint(*listenMode, 8, 32)
+		check(err == nil, "listen-mode: invalid permissions %q: expected octal number", *listenMode)
+	}
+	if *redirectHTTP != "" {
+		_, _, err := net.SplitHostPort(*redirectHTTP)
+		check(err == nil, "redirect-http: invalid address %q: %v", *redirectHTTP, err)
+	}
+	check(strings.HasPrefix(*root, "/"), "root: %q must start with '/'", *root)
+	check(*metricsPath == "" || strings.HasPrefix(*metricsPath, "/"),
+		"metrics-path: %q must start with '/'", *metricsPath)
+	check(!*metricsPublic || *metricsPath != "", "metrics-public: requires metrics-path")
+	check(*shutdownTimeout > 0, "shutdown-timeout: must be positive")
+	check(*readyTimeout > 0, "ready-timeout: must be positive")
+	check(*cacheSize >= 0, "cache-size: must not be negative")
+	check(*cacheLiveTTL >= 0, "cache-ttl-live: must not be negative")
+	check(*rateLimit >= 0, "rate-limit: must not be negative")
+	check(*rateBurst >= 0, "rate-burst: must not be negative")
+	check(*maxConcurrent >= 0, "max-concurrent: must not be negative")
+	check(*maxGraphMetrics >= 0, "max-graph-metrics: must not be negative")
+	check(*snapshotInterval > 0, "snapshot-interval: must be positive")
+	check(*historySize > 0, "history-size: must be positive")
+	check(*hsts >= 0, "hsts: must not be negative")
+	check(*accessLogFormat == server.LogText || *accessLogFormat == server.LogJSON,
+		"access-log-format: unknown format %q", *accessLogFormat)
+
+	check(*tlsKey == "" || *tlsCert != "", "tls-key: requires tls-cert")
+	check(*tlsCert == "" || *tlsKey != "", "tls-cert: requires tls-key")
+	check(*tlsClientCA == "" || *tlsCert != "", "tls-client-ca: requires tls-cert")
+	check(!*tlsClientAuth || *tlsClientCA != "", "tls-require-client-cert: requires tls-client-ca")
+	check(*redirectHTTP == "" || *tlsCert != "", "redirect-http: requires tls-cert")
+	check(*hsts == 0 || *tlsCert != "", "hsts: requires tls-cert")
+	check(!*dev || *tmpl != "", "dev: requires template-path")
+	check(*auth != "cert" || *tlsClientCA != "", "auth: cert authentication requires tls-client-ca")
+	check(*admins == "" || *auth != "none", "admins: requires auth")
+
+	for name, dir := range map[string]string{"template-path": *tmpl, "static-path": *static, "theme": *theme} {
+		if dir == "" {
+			continue
+		}
+		fi, err := os.Stat(dir)
+		if err == nil && !fi.IsDir() {
+			err = fmt.Errorf("not a directory")
+		}
+		check(err == nil, "%s: %v", name, err)
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
@@ -0,0 +1,214 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOptionValue(t *testing.T) {
+	for _, test := range []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{`":8080"`, ":8080", false},
+		{`true`, "true", false},
+		{`1000`, "1000", false},
+		{`0.5`, "0.5", false},
+		{`["10.0.0.0/8", "::1/128"]`, "10.0.0.0/8,::1/128", false},
+		{`[]`, "", false},
+		{`[1, 2]`, "", true},
+		{`{"a": "b"}`, "", true},
+		{`null`, "", true},
+	} {
+		got, err := optionValue(json.RawMessage(test.raw))
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("optionValue(%s) = %q, %v; want %q, error: %v", test.raw, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	dir := t.TempDir()
+	for _, test := range []struct {
+		name string
+		data string
+		want map[string]string
+		err  string
+	}{
+		{
+			data: `{"listen": ":9090", "cache-size": 10, "auth-proxies": ["10.0.0.0/8"]}`,
+			want: map[string]string{"listen": ":9090", "cache-size": "10", "auth-proxies": "10.0.0.0/8"},
+		},
+		{data: `{}`, want: map[string]string{}},
+		{data: `{"no-such-option": 1}`, err: `unknown option "no-such-option"`},
+		{data: `{"config": "other.json"}`, err: `unknown option "config"`},
+		{data: `{"listen": {}}`, err: "invalid value for listen"},
+		{data: "{\n\t\"listen\": \":9090\",\n}", err: "config.json:3:1"},
+		{data: `[]`, err: "cannot unmarshal"},
+		{
+			name: "config.toml",
+			data: "listen = \":9090\"\ncache-size = 10\nauth-proxies = [\"10.0.0.0/8\"]\n",
+			want: map[string]string{"listen": ":9090", "cache-size": "10", "auth-proxies": "10.0.0.0/8"},
+		},
+		{name: "config.toml", data: "no-such-option = 1", err: `unknown option "no-such-option"`},
+		{name: "config.toml", data: "listen = \":9090\"\n\n[tls]\n", err: "config.toml:3:1: tables are not supported"},
+	} {
+		if test.name == "" {
+			test.name = "config.json"
+		}
+		path := filepath.Join(dir, test.name)
+		if err := os.WriteFile(path, []byte(test.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readConfig(path)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("readConfig(%s) = %v; want error containing %q", test.data, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("readConfig(%s) = %v; want <nil>", test.data, err)
+			continue
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("readConfig(%s) = %v; want %v", test.data, got, test.want)
+		}
+		for k, v := range test.want {
+			if got[k] != v {
+				t.Errorf("readConfig(%s)[%s] = %q; want %q", test.data, k, got[k], v)
+			}
+		}
+	}
+}
+
+// resetConfig resets all options not specified on the command line to
+// their default values.
+func resetConfig(t *testing.T) {
+	*configFile = ""
+	if err := loadConfig(); err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Cleanup(func() { resetConfig(t) })
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	write := func(data string) {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"listen": ":1", "banner": "file", "site-name": "file", "cache-size": 5}`)
+	*configFile = path
+	t.Setenv("SYSDBWEBUI_BANNER", "env")
+	t.Setenv("SYSDBWEBUI_SITE_NAME", "env")
+	if err := flag.Set("site-name", "cmdline"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loadConfig(); err != nil {
+		t.Fatalf("loadConfig() = %v; want <nil>", err)
+	}
+	for _, test := range []struct {
+		name, want string
+	}{
+		{"listen", ":1"},
+		{"cache-size", "5"},
+		{"banner", "env"},
+		{"site-name", "cmdline"},
+		{"rate-burst", "0"},
+	} {
+		if got := flag.Lookup(test.name).Value.String(); got != test.want {
+			t.Errorf("loadConfig(): %s = %q; want %q", test.name, got, test.want)
+		}
+	}
+
+	// Options removed from the file are reset.
+	write(`{"banner": "file"}`)
+	if err := loadConfig(); err != nil {
+		t.Fatalf("loadConfig() = %v; want <nil>", err)
+	}
+	if *listen != ":8080" || *cacheSize != 0 {
+		t.Errorf("loadConfig() after removing options: listen = %q, cache-size = %d; want defaults", *listen, *cacheSize)
+	}
+
+	t.Setenv("SYSDBWEBUI_CACHE_SIZE", "many")
+	err := loadConfig()
+	if want := `SYSDBWEBUI_CACHE_SIZE: invalid value "many" for cache-size`; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("loadConfig() = %v; want error containing %q", err, want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Cleanup(func() { resetConfig(t) })
+
+	for _, test := range []struct {
+		opts map[string]string
+		want string
+	}{
+		{nil, ""},
+		{map[string]string{"address": "", "instances": ""}, "address: SysDB address must not be empty"},
+		{map[string]string{"federated": "true"}, "federated: requires instances"},
+		{map[string]string{"listen": "localhost"}, `listen: invalid address "localhost"`},
+		{map[string]string{"listen": "unix:,systemd"}, `listen: missing socket path in "unix:"`},
+		{map[string]string{"listen-mode": "rw"}, `listen-mode: invalid permissions "rw"`},
+		{map[string]string{"root": "sysdb/"}, `root: "sysdb/" must start with '/'`},
+		{map[string]string{"tls-key": "key.pem"}, "tls-key: requires tls-cert"},
+		{map[string]string{"hsts": "1h"}, "hsts: requires tls-cert"},
+		{map[string]string{"admins": "alice"}, "admins: requires auth"},
+		{map[string]string{"metrics-public": "true"}, "metrics-public: requires metrics-path"},
+		{map[string]string{"access-log-format": "xml"}, `access-log-format: unknown format "xml"`},
+		{map[string]string{"template-path": "/nonexistent"}, "template-path: "},
+		{map[string]string{"cache-size": "-1", "rate-burst": "-1"},
+			"cache-size: must not be negative\nrate-burst: must not be negative"},
+	} {
+		resetConfig(t)
+		for name, value := range test.opts {
+			if err := flag.Lookup(name).Value.Set(value); err != nil {
+				t.Fatalf("Set(%s, %q) = %v", name, value, err)
+			}
+		}
+		err := validate()
+		if test.want == "" {
+			if err != nil {
+				t.Errorf("validate(%v) = %v; want <nil>", test.opts, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("validate(%v) = %v; want error containing %q", test.opts, err, test.want)
+		}
+	}
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
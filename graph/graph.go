@@ -63,13 +63,18 @@ type Graph struct {
 	GroupBy []string
 }
 
+// A Client executes SysDB queries. It's implemented by *client.Client.
+type Client interface {
+	Query(q string) (interface{}, error)
+}
+
 type pl struct {
 	*plot.Plot
 
 	ts int // Index of the current time-series.
 }
 
-func queryTimeseries(c *client.Client, metric Metric, start, end time.Time) (*sysdb.Timeseries, error) {
+func queryTimeseries(c Client, metric Metric, start, end time.Time) (*sysdb.Timeseries, error) {
 	q, err := client.QueryString("TIMESERIES %s.%s START %s END %s",
 		metric.Hostname, metric.Identifier, start, end)
 	if err != nil {
@@ -87,7 +92,7 @@ func queryTimeseries(c *client.Client, metric Metric, start, end time.Time) (*sy
 	return ts, nil
 }
 
-func (p *pl) addTimeseries(c *client.Client, metric Metric, verbose bool) error {
+func (p *pl) addTimeseries(c Client, metric Metric, verbose bool) error {
 	for name, data := range metric.ts.Data {
 		pts := make(plotter.XYs, len(data))
 		for i, p := range data {
@@ -175,7 +180,7 @@ func sum(ts1, ts2 *sysdb.Timeseries) error {
 	return nil
 }
 
-func (g *Graph) group(c *client.Client, start, end time.Time) ([]Metric, error) {
+func (g *Graph) group(c Client, start, end time.Time) ([]Metric, error) {
 	if len(g.GroupBy) == 0 {
 		for i, m := range g.Metrics {
 			var err error
@@ -232,7 +237,7 @@ func (g *Graph) group(c *client.Client, start, end time.Time) ([]Metric, error)
 
 // Plot fetches a graph's time-series data using the specified client and
 // plots it.
-func (g *Graph) Plot(c *client.Client) (*plot.Plot, error) {
+func (g *Graph) Plot(c Client) (*plot.Plot, error) {
 	var err error
 
 	p := &pl{}
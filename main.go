@@ -27,25 +27,98 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"embed"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/sysdb/webui/server"
 )
 
 var (
-	addr     = flag.String("address", "/var/run/sysdbd.sock", "SysDB server address")
-	username *string
+	addr      = flag.String("address", "/var/run/sysdbd.sock", "SysDB server address")
+	username  *string
+	instances = flag.String("instances", "", "comma-separated list of named SysDB instances (NAME=ADDRESS) overriding -address")
+	federated = flag.Bool("federated", false, "merge the results of all instances in the \"all\" view")
 
-	listen = flag.String("listen", ":8080", "address to listen for incoming connections")
-	tmpl   = flag.String("template-path", "templates", "location of template files")
-	static = flag.String("static-path", "static", "location of static files")
+	listen          = flag.String("listen", ":8080", "comma-separated list of addresses to listen on (HOST:PORT, unix:PATH, or systemd for socket activation)")
+	listenMode      = flag.String("listen-mode", "", "permissions of Unix sockets (octal, e.g. 0660)")
+	clientHeader    = flag.String("client-header", "", "header identifying clients on Unix sockets, set by the reverse proxy (e.g. X-Forwarded-For)")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "maximum time to wait for active requests when shutting down")
+	compressMinSize = flag.Int("compress-min-size", 1024, "minimum size of responses compressed using gzip or deflate (disabled if negative)")
+
+	cacheSize    = flag.Int("cache-size", 0, "maximum number of cached query results (caching is disabled if zero)")
+	cacheTTL     = flag.String("cache-ttl", "FETCH=10s,LIST=10s,LOOKUP=10s,TIMESERIES=5m", "comma-separated list of cache lifetimes by kind of query")
+	cacheLiveTTL = flag.Duration("cache-ttl-live", 5*time.Second, "cache lifetime of time-series ending at the current time")
+
+	rateLimit       = flag.Float64("rate-limit", 0, "expensive requests (graphs, lookups, exports) per second permitted per client (unlimited if zero)")
+	rateBurst       = flag.Int("rate-burst", 0, "number of expensive requests a client may issue at once (one if zero)")
+	maxConcurrent   = flag.Int("max-concurrent", 0, "maximum number of expensive requests served concurrently (unlimited if zero)")
+	maxGraphMetrics = flag.Int("max-graph-metrics", 0, "maximum number of metrics included in a single graph (unlimited if zero)")
+
+	readyTimeout    = flag.Duration("ready-timeout", 2*time.Second, "maximum time to wait for SysDB when checking readiness")
+	metricsPath     = flag.String("metrics-path", "", "path serving metrics in the Prometheus format (disabled if empty)")
+	metricsPublic   = flag.Bool("metrics-public", false, "serve metrics without requiring authentication")
+	accessLog       = flag.String("access-log", "", "access log file (\"-\" for standard output, disabled if empty)")
+	accessLogFormat = flag.String("access-log-format", server.LogText, "access log format (text, json)")
+
+	tmpl   = flag.String("template-path", "", "location of template files overriding the built-in templates")
+	static = flag.String("static-path", "", "location of static files overriding the built-in files")
 
 	root = flag.String("root", "/", "root mount point of the server")
+	dev  = flag.Bool("dev", false, "development mode: reload templates from -template-path on changes")
+
+	theme       = flag.String("theme", "", "directory containing templates and static files overriding the built-in ones")
+	siteName    = flag.String("site-name", "SysDB", "site name used in page titles and the top menu")
+	homeURL     = flag.String("home-url", "https://sysdb.io", "target of the site name link in the top menu")
+	logo        = flag.String("logo", "", "URL of the logo (relative to the root mount point)")
+	navLinks    = flag.String("nav-links", "", "comma-separated list of additional navigation links (title=URL)")
+	banner      = flag.String("banner", "", "banner displayed on all pages (e.g. PRODUCTION)")
+	bannerColor = flag.String("banner-color", "#c00", "background color of the banner")
+
+	snapshotPath     = flag.String("snapshot-path", "", "location of inventory snapshots (disabled if empty)")
+	snapshotInterval = flag.Duration("snapshot-interval", time.Hour, "interval between inventory snapshots")
+	historySize      = flag.Int("history-size", 10000, "maximum number of inventory changes kept")
+
+	auth        = flag.String("auth", "none", "authentication provider (none, htpasswd, proxy, cert)")
+	htpasswd    = flag.String("htpasswd", "", "htpasswd file used by the htpasswd authentication provider")
+	authHeader  = flag.String("auth-header", "X-Remote-User", "user name header set by a trusted reverse proxy")
+	authProxies = flag.String("auth-proxies", "127.0.0.1/32,::1/128", "comma-separated list of networks of trusted reverse proxies (\"unix\" trusts Unix sockets)")
+	identities  = flag.String("identities", "", "JSON file mapping web users to SysDB users and host filters")
+	admins      = flag.String("admins", "", "comma-separated list of users allowed to administer the webui (e.g. to flush the cache)")
+
+	tlsCert       = flag.String("tls-cert", "", "TLS certificate file (enables HTTPS)")
+	tlsKey        = flag.String("tls-key", "", "TLS private key file")
+	tlsClientCA   = flag.String("tls-client-ca", "", "CA certificates used to verify TLS client certificates")
+	tlsClientAuth = flag.Bool("tls-require-client-cert", false, "require TLS client certificates")
+	redirectHTTP  = flag.String("redirect-http", "", "address to listen on for HTTP requests to be redirected to HTTPS")
+	hsts          = flag.Duration("hsts", 0, "max-age of HTTP Strict Transport Security (disabled if zero)")
+
+	csp            = flag.String("csp", server.DefaultHeaders["Content-Security-Policy"], "Content-Security-Policy header (omitted if empty)")
+	frameOptions   = flag.String("frame-options", server.DefaultHeaders["X-Frame-Options"], "X-Frame-Options header (omitted if empty)")
+	referrerPolicy = flag.String("referrer-policy", server.DefaultHeaders["Referrer-Policy"], "Referrer-Policy header (omitted if empty)")
+)
+
+// Built-in templates and static files.
+var (
+	//go:embed templates
+	templateFiles embed.FS
+	//go:embed static
+	staticFiles embed.FS
 )
 
 func init() {
@@ -63,22 +136,416 @@ func init() {
 func main() {
 	flag.Parse()
 
-	log.Printf("Connecting to SysDB at %s.", *addr)
-	srv, err := server.New(*addr, *username, server.Config{
+	cfg, err := loadAll()
+	if err != nil {
+		fatalf("Invalid configuration:\n%v", err)
+	}
+	if *checkConfig {
+		fmt.Println("Configuration OK")
+		return
+	}
+	if err := openAccessLog(); err != nil {
+		fatalf("%v", err)
+	}
+
+	if len(cfg.Instances) == 0 {
+		log.Printf("Connecting to SysDB at %s.", *addr)
+	}
+	for _, inst := range cfg.Instances {
+		log.Printf("Connecting to SysDB instance %s at %s.", inst.Name, inst.Address)
+	}
+	srv, err := server.New(*addr, *username, cfg)
+	if err != nil {
+		fatalf("Failed to construct web-server: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(*root, srv)
+	if *metricsPath != "" {
+		mux.Handle(*metricsPath, srv.Metrics())
+	}
+	var handler http.Handler = mux
+	if *compressMinSize >= 0 {
+		handler = server.Compress(mux, *compressMinSize)
+	}
+	httpSrv := &http.Server{Addr: *listen, Handler: handler}
+	var redirectSrv *http.Server
+
+	ls, err := listeners()
+	if err != nil {
+		fatalf("Failed to set up listeners: %v", err)
+	}
+	errc := make(chan error, len(ls)+1)
+	if *tlsCert != "" {
+		if httpSrv.TLSConfig, err = tlsConfig(); err != nil {
+			fatalf("Failed to set up TLS: %v", err)
+		}
+		if *redirectHTTP != "" {
+			redirectSrv = &http.Server{Addr: *redirectHTTP, Handler: server.RedirectHTTPS(httpsAddr())}
+			log.Printf("Redirecting HTTP requests on %s.", *redirectHTTP)
+			go func() { errc <- redirectSrv.ListenAndServe() }()
+		}
+	}
+	for _, l := range ls {
+		l := l
+		if *tlsCert == "" {
+			log.Printf("Listening on %s.", l.Addr())
+			go func() { errc <- httpSrv.Serve(l) }()
+		} else {
+			log.Printf("Listening on %s (TLS).", l.Addr())
+			go func() { errc <- httpSrv.ServeTLS(l, "", "") }()
+		}
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for {
+		select {
+		case err := <-errc:
+			fatalf("Failed to set up HTTP server: %v", err)
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				reload(srv)
+				continue
+			}
+			log.Printf("Received %v, shutting down.", sig)
+			shutdown(srv, httpSrv, redirectSrv)
+			return
+		}
+	}
+}
+
+// loadAll loads and validates the configuration from all sources.
+func loadAll() (server.Config, error) {
+	if err := loadConfig(); err != nil {
+		return server.Config{}, err
+	}
+	if err := validate(); err != nil {
+		return server.Config{}, err
+	}
+	cfg, err := config()
+	if err != nil {
+		return server.Config{}, err
+	}
+	if *dev && !*checkConfig {
+		// Template errors are reported in the browser.
+		return cfg, nil
+	}
+	return cfg, cfg.Validate()
+}
+
+// config constructs the server configuration from the command line options.
+func config() (server.Config, error) {
+	a, err := authenticator()
+	if err != nil {
+		return server.Config{}, fmt.Errorf("Failed to set up authentication: %v", err)
+	}
+	var ids map[string]server.Identity
+	if *identities != "" {
+		if ids, err = server.LoadIdentities(*identities); err != nil {
+			return server.Config{}, fmt.Errorf("Failed to load identities: %v", err)
+		}
+	}
+
+	builtinTmpl, err := fs.Sub(templateFiles, "templates")
+	if err != nil {
+		return server.Config{}, err
+	}
+	builtinStatic, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		return server.Config{}, err
+	}
+
+	var logOut io.Writer
+	switch *accessLog {
+	case "":
+	case "-":
+		logOut = os.Stdout
+	default:
+		// Opened by openAccessLog.
+		logOut = accessLogFile
+	}
+
+	ttls := make(map[string]time.Duration)
+	for _, t := range strings.Split(*cacheTTL, ",") {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		kv := strings.SplitN(t, "=", 2)
+		if len(kv) != 2 {
+			return server.Config{}, fmt.Errorf("Invalid cache TTL %q: expected kind=duration", t)
+		}
+		d, err := time.ParseDuration(kv[1])
+		if err != nil {
+			return server.Config{}, fmt.Errorf("Invalid cache TTL %q: %v", t, err)
+		}
+		ttls[strings.ToUpper(kv[0])] = d
+	}
+
+	var links []server.Link
+	for _, l := range strings.Split(*navLinks, ",") {
+		if l = strings.TrimSpace(l); l == "" {
+			continue
+		}
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return server.Config{}, fmt.Errorf("Invalid navigation link %q: expected title=URL", l)
+		}
+		links = append(links, server.Link{Title: kv[0], URL: kv[1]})
+	}
+
+	var adminUsers []string
+	for _, u := range strings.Split(*admins, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			adminUsers = append(adminUsers, u)
+		}
+	}
+
+	var insts []server.Instance
+	for _, i := range strings.Split(*instances, ",") {
+		if i = strings.TrimSpace(i); i == "" {
+			continue
+		}
+		kv := strings.SplitN(i, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return server.Config{}, fmt.Errorf("Invalid instance %q: expected name=address", i)
+		}
+		insts = append(insts, server.Instance{Name: kv[0], Address: kv[1], User: *username})
+	}
+
+	return server.Config{
 		TemplatePath: *tmpl,
+		Templates:    builtinTmpl,
 		StaticPath:   *static,
+		Static:       builtinStatic,
 		Root:         *root,
-	})
+
+		Instances: insts,
+		Federated: *federated,
+
+		Theme: *theme,
+		Branding: server.Branding{
+			SiteName:    *siteName,
+			HomeURL:     *homeURL,
+			Logo:        *logo,
+			Links:       links,
+			Banner:      *banner,
+			BannerColor: *bannerColor,
+		},
+
+		SnapshotPath:     *snapshotPath,
+		SnapshotInterval: *snapshotInterval,
+		HistorySize:      *historySize,
+
+		Auth:       a,
+		Identities: ids,
+		Admins:     adminUsers,
+		HSTS:       *hsts,
+		Headers: map[string]string{
+			"Content-Security-Policy": *csp,
+			"X-Frame-Options":         *frameOptions,
+			"X-Content-Type-Options":  server.DefaultHeaders["X-Content-Type-Options"],
+			"Referrer-Policy":         *referrerPolicy,
+		},
+		Dev: *dev,
+
+		Cache: server.CacheConfig{
+			Size:    *cacheSize,
+			TTL:     ttls,
+			LiveTTL: *cacheLiveTTL,
+		},
+		ReadyTimeout: *readyTimeout,
+
+		AccessLog:       logOut,
+		AccessLogFormat: *accessLogFormat,
+
+		Limits: server.LimitConfig{
+			Rate:            *rateLimit,
+			Burst:           *rateBurst,
+			Concurrency:     *maxConcurrent,
+			MaxGraphMetrics: *maxGraphMetrics,
+		},
+		ClientHeader:  *clientHeader,
+		MetricsPublic: *metricsPublic,
+	}, nil
+}
+
+// A logFile is a file which may be reopened while in use.
+type logFile struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+var accessLogFile = &logFile{}
+
+// openAccessLog opens the access log file, if any. It is reopened on every
+// reload to support log rotation.
+func openAccessLog() error {
+	if *accessLog == "" || *accessLog == "-" {
+		return nil
+	}
+	if err := accessLogFile.open(*accessLog); err != nil {
+		return fmt.Errorf("Failed to open access log: %v", err)
+	}
+	return nil
+}
+
+// open (re)opens the file at the specified path for appending.
+func (l *logFile) open(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
-		fatalf("Failed to construct web-server: %v", err)
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		l.f.Close()
 	}
+	l.f = f
+	return nil
+}
 
-	log.Printf("Listening on %s.", *listen)
-	http.Handle(*root, srv)
-	err = http.ListenAndServe(*listen, nil)
+func (l *logFile) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Write(b)
+}
+
+// reload re-reads all templates and configuration files. The previous
+// configuration remains in place on errors. Changes to the listening
+// addresses, TLS settings, and the connection to SysDB require a restart.
+func reload(srv *server.Server) {
+	log.Printf("Reloading configuration.")
+	cfg, err := loadAll()
+	if err == nil {
+		err = openAccessLog()
+	}
+	if err == nil {
+		err = srv.Reload(cfg)
+	}
+	if err != nil {
+		log.Printf("Failed to reload configuration: %v", err)
+	}
+}
+
+// shutdown waits for all active requests to complete (up to the configured
+// timeout) and closes all connections to SysDB.
+func shutdown(srv *server.Server, servers ...*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	for _, s := range servers {
+		if s == nil {
+			continue
+		}
+		if err := s.Shutdown(ctx); err != nil {
+			log.Printf("Failed to shut down HTTP server on %s: %v", s.Addr, err)
+		}
+	}
+	srv.Close()
+}
+
+// listenAddrs returns the list of addresses specified by -listen.
+func listenAddrs() []string {
+	var addrs []string
+	for _, a := range strings.Split(*listen, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+// listeners opens all listeners specified by -listen.
+func listeners() ([]net.Listener, error) {
+	var perm os.FileMode
+	if *listenMode != "" {
+		m, err := strconv.ParseUint(*listenMode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -listen-mode %q: %v", *listenMode, err)
+		}
+		perm = os.FileMode(m)
+	}
+
+	var ls []net.Listener
+	for _, a := range listenAddrs() {
+		var err error
+		if a == "systemd" {
+			var sls []net.Listener
+			if sls, err = server.SystemdListeners(); err == nil && len(sls) == 0 {
+				err = fmt.Errorf("no sockets passed on by systemd")
+			}
+			ls = append(ls, sls...)
+		} else {
+			var l net.Listener
+			if l, err = server.Listen(a, perm); err == nil {
+				ls = append(ls, l)
+			}
+		}
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, fmt.Errorf("%s: %v", a, err)
+		}
+	}
+	return ls, nil
+}
+
+// httpsAddr returns the first TCP address the server listens on.
+func httpsAddr() string {
+	for _, a := range listenAddrs() {
+		if a != "systemd" && !strings.HasPrefix(a, "unix:") {
+			return a
+		}
+	}
+	return ""
+}
+
+// tlsConfig constructs the TLS configuration selected on the command line.
+func tlsConfig() (*tls.Config, error) {
+	if *tlsKey == "" {
+		return nil, fmt.Errorf("missing -tls-key file")
+	}
+	l, err := server.NewCertLoader(*tlsCert, *tlsKey)
 	if err != nil {
-		fatalf("Failed to set up HTTP server on address %q: %v", *listen, err)
+		return nil, err
+	}
+	return server.TLSConfig(l, *tlsClientCA, *tlsClientAuth)
+}
+
+// authenticator constructs the authentication provider selected on the
+// command line.
+func authenticator() (server.Authenticator, error) {
+	switch *auth {
+	case "none":
+		return nil, nil
+	case "htpasswd":
+		if *htpasswd == "" {
+			return nil, fmt.Errorf("missing -htpasswd file")
+		}
+		return server.NewHtpasswd(*htpasswd)
+	case "proxy":
+		p := &server.ProxyHeader{Header: *authHeader}
+		for _, n := range strings.Split(*authProxies, ",") {
+			if n = strings.TrimSpace(n); n == "" {
+				continue
+			} else if n == "unix" {
+				p.Unix = true
+				continue
+			}
+			_, ipnet, err := net.ParseCIDR(n)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy network: %v", err)
+			}
+			p.Trusted = append(p.Trusted, ipnet)
+		}
+		return p, nil
+	case "cert":
+		return server.ClientCert{}, nil
 	}
+	return nil, fmt.Errorf("unknown authentication provider %q", *auth)
 }
 
 func fatalf(format string, a ...interface{}) {
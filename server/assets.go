@@ -0,0 +1,108 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+// Helper functions for accessing templates and static files.
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// An overlay is a file system made up of multiple layers. Files are looked
+// up in each layer in order; the first layer providing a file wins.
+type overlay []fs.FS
+
+// newOverlay constructs an overlay of the specified directories (ignoring
+// empty names) in order, followed by the default file system (if not nil).
+func newOverlay(defaults fs.FS, dirs ...string) (overlay, error) {
+	var o overlay
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			return nil, errors.New(dir + ": not a directory")
+		}
+		o = append(o, os.DirFS(dir))
+	}
+	if defaults != nil {
+		o = append(o, defaults)
+	}
+	if len(o) == 0 {
+		return nil, errors.New("no location specified")
+	}
+	return o, nil
+}
+
+// Open implements the fs.FS interface.
+func (o overlay) Open(name string) (fs.File, error) {
+	var err error
+	for _, fsys := range o {
+		var f fs.File
+		if f, err = fsys.Open(name); err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// serveFile serves the named file from the file system.
+func serveFile(w http.ResponseWriter, r *http.Request, fsys fs.FS, name string) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	f, err := fsys.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	rs, ok := f.(io.ReadSeeker)
+	if !ok {
+		http.Error(w, "File does not support seeking", http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), rs)
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
@@ -0,0 +1,104 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+import (
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestOverlay(t *testing.T) {
+	o := overlay{
+		fstest.MapFS{"main.tmpl": {Data: []byte("custom")}},
+		fstest.MapFS{
+			"main.tmpl": {Data: []byte("default")},
+			"host.tmpl": {Data: []byte("host")},
+		},
+	}
+
+	for _, test := range []struct {
+		name string
+		want string
+	}{
+		{"main.tmpl", "custom"},
+		{"host.tmpl", "host"},
+		{"hosts.tmpl", ""},
+	} {
+		f, err := o.Open(test.name)
+		if test.want == "" {
+			if err == nil {
+				f.Close()
+				t.Errorf("Open(%q) = <nil>; want %v", test.name, fs.ErrNotExist)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Open(%q) = %v; want <nil>", test.name, err)
+			continue
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil || string(data) != test.want {
+			t.Errorf("Open(%q) = %q (%v); want %q", test.name, data, err, test.want)
+		}
+	}
+}
+
+func TestServeBody(t *testing.T) {
+	modified := time.Date(2014, 12, 1, 13, 37, 0, 0, time.UTC)
+	w := httptest.NewRecorder()
+	serveBody(w, httptest.NewRequest("GET", "/", nil), []byte("body"), modified)
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" || w.Body.String() != "body" {
+		t.Fatalf("serveBody() = %d, ETag %q, %q; want %d, <etag>, %q",
+			w.Code, etag, w.Body.String(), http.StatusOK, "body")
+	}
+
+	for _, test := range []struct {
+		header, value string
+		want          int
+	}{
+		{"If-None-Match", etag, http.StatusNotModified},
+		{"If-None-Match", `"other"`, http.StatusOK},
+		{"If-Modified-Since", modified.Format(http.TimeFormat), http.StatusNotModified},
+		{"If-Modified-Since", modified.Add(-time.Hour).Format(http.TimeFormat), http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(test.header, test.value)
+		w := httptest.NewRecorder()
+		serveBody(w, r, []byte("body"), modified)
+		if w.Code != test.want {
+			t.Errorf("serveBody(%s: %s) = %d; want %d", test.header, test.value, w.Code, test.want)
+		}
+	}
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
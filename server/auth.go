@@ -0,0 +1,525 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+// Authentication of web users.
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An Authenticator determines the identity of the user issuing a request.
+type Authenticator interface {
+	// Authenticate returns the name of the user issuing the request or an
+	// empty string if the request does not carry any credentials.
+	Authenticate(r *http.Request) (string, error)
+}
+
+// A PasswordAuthenticator is an Authenticator which additionally supports
+// checking a user's password. The server offers a login form for password
+// authenticators and keeps track of logged in users using a session cookie.
+type PasswordAuthenticator interface {
+	Authenticator
+
+	// CheckPassword returns true if the password is valid for the user.
+	CheckPassword(user, password string) bool
+}
+
+// Htpasswd authenticates users against an htpasswd file. It supports Apache
+// MD5 (apr1) and SHA1 password hashes. Requests may authenticate
+// using HTTP basic authentication or by logging in.
+type Htpasswd struct {
+	path string
+
+	mu    sync.RWMutex
+	users map[string]string
+}
+
+// NewHtpasswd loads the htpasswd file at the specified path.
+func NewHtpasswd(path string) (*Htpasswd, error) {
+	h := &Htpasswd{path: path}
+	if err := h.Reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Reload re-reads the htpasswd file.
+func (h *Htpasswd) Reload() error {
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 || fields[0] == "" {
+			return fmt.Errorf("%s:%d: invalid entry", h.path, n)
+		}
+		hash := fields[1]
+		if strings.HasPrefix(hash, "$2") {
+			return fmt.Errorf("%s:%d: bcrypt password hash for user %q is not supported; use \"htpasswd -m\"",
+				h.path, n, fields[0])
+		}
+		if !strings.HasPrefix(hash, "$apr1$") && !strings.HasPrefix(hash, "{SHA}") {
+			return fmt.Errorf("%s:%d: unsupported password hash for user %q",
+				h.path, n, fields[0])
+		}
+		users[fields[0]] = hash
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.users = users
+	h.mu.Unlock()
+	return nil
+}
+
+// Authenticate implements the Authenticator interface using HTTP basic
+// authentication.
+func (h *Htpasswd) Authenticate(r *http.Request) (string, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", nil
+	}
+	if !h.CheckPassword(user, password) {
+		return "", fmt.Errorf("invalid password for user %q", user)
+	}
+	return user, nil
+}
+
+// CheckPassword implements the PasswordAuthenticator interface.
+func (h *Htpasswd) CheckPassword(user, password string) bool {
+	h.mu.RLock()
+	hash, ok := h.users[user]
+	h.mu.RUnlock()
+	if !ok {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt := strings.SplitN(hash[len("$apr1$"):], "$", 2)[0]
+		return equal(apr1(password, salt), hash)
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return equal("{SHA}"+base64.StdEncoding.EncodeToString(sum[:]), hash)
+	}
+	return false
+}
+
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+const apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1 computes the Apache MD5 hash of a password.
+func apr1(password, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw, sb := []byte(password), []byte(salt)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write(sb)
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte("$apr1$"))
+	ctx.Write(sb)
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(altSum)
+		} else {
+			ctx.Write(altSum[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	sum := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		ctx := md5.New()
+		if i&1 == 1 {
+			ctx.Write(pw)
+		} else {
+			ctx.Write(sum)
+		}
+		if i%3 != 0 {
+			ctx.Write(sb)
+		}
+		if i%7 != 0 {
+			ctx.Write(pw)
+		}
+		if i&1 == 1 {
+			ctx.Write(sum)
+		} else {
+			ctx.Write(pw)
+		}
+		sum = ctx.Sum(nil)
+	}
+
+	enc := make([]byte, 0, 22)
+	to64 := func(v uint, n int) {
+		for ; n > 0; n-- {
+			enc = append(enc, apr1Alphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, i := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint(sum[i[0]])<<16|uint(sum[i[1]])<<8|uint(sum[i[2]]), 4)
+	}
+	to64(uint(sum[11]), 2)
+	return "$apr1$" + salt + "$" + string(enc)
+}
+
+// ProxyHeader trusts a reverse proxy to authenticate users. The proxy passes
+// on the user name in an HTTP header. The header is only accepted from the
+// trusted networks and, if enabled, on Unix domain sockets.
+type ProxyHeader struct {
+	// Name of the header (e.g. X-Remote-User).
+	Header string
+
+	// Networks of trusted proxies.
+	Trusted []*net.IPNet
+
+	// Trust all connections on Unix domain sockets (including those passed
+	// on by systemd). Access to the socket is restricted by its permissions.
+	Unix bool
+}
+
+// Authenticate implements the Authenticator interface.
+func (p *ProxyHeader) Authenticate(r *http.Request) (string, error) {
+	user := r.Header.Get(p.Header)
+	if user == "" {
+		return "", nil
+	}
+
+	if a, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && a.Network() == "unix" {
+		if p.Unix {
+			return user, nil
+		}
+		return "", fmt.Errorf("ignoring %s header from untrusted Unix socket %s", p.Header, a)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	for _, n := range p.Trusted {
+		if ip != nil && n.Contains(ip) {
+			return user, nil
+		}
+	}
+	return "", fmt.Errorf("ignoring %s header from untrusted address %s", p.Header, r.RemoteAddr)
+}
+
+// ClientCert authenticates users based on verified TLS client certificates.
+// The user name is the common name of the certificate's subject.
+type ClientCert struct{}
+
+// Authenticate implements the Authenticator interface.
+func (ClientCert) Authenticate(r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", nil
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName, nil
+}
+
+// Session handling for password authenticators.
+
+const (
+	sessionCookie   = "sysdb_session"
+	sessionLifetime = 12 * time.Hour
+)
+
+// A sessions issues and verifies signed session tokens.
+type sessions struct {
+	key []byte
+
+	// Generation of the sessions of each user. Tokens of older generations
+	// have been revoked.
+	mu  sync.Mutex
+	gen map[string]uint64
+}
+
+// newSessions returns sessions using a random key.
+func newSessions() (*sessions, error) {
+	s := &sessions{key: make([]byte, 32)}
+	if _, err := rand.Read(s.key); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// issue returns a new session token for the user which expires at the
+// specified time.
+func (s *sessions) issue(user string, expires time.Time) string {
+	v := base64.RawURLEncoding.EncodeToString([]byte(user)) +
+		"." + strconv.FormatUint(s.generation(user), 10) +
+		"." + strconv.FormatInt(expires.Unix(), 10)
+	return v + "." + s.sign(v)
+}
+
+// verify returns the user of a valid session token.
+func (s *sessions) verify(token string, now time.Time) (string, bool) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 || !hmac.Equal([]byte(token[i+1:]), []byte(s.sign(token[:i]))) {
+		return "", false
+	}
+	fields := strings.SplitN(token[:i], ".", 3)
+	if len(fields) != 3 {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || now.Unix() >= expires {
+		return "", false
+	}
+	user, err := base64.RawURLEncoding.DecodeString(fields[0])
+	if err != nil {
+		return "", false
+	}
+	gen, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil || gen != s.generation(string(user)) {
+		return "", false
+	}
+	return string(user), true
+}
+
+// revoke invalidates all sessions of the user issued so far.
+func (s *sessions) revoke(user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gen == nil {
+		s.gen = make(map[string]uint64)
+	}
+	s.gen[user]++
+}
+
+func (s *sessions) generation(user string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gen[user]
+}
+
+func (s *sessions) sign(v string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(v))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Commands which are available without authentication.
+var public = map[string]bool{
+	"images":  true,
+	"style":   true,
+	"login":   true,
+	"logout":  true,
+	"healthz": true,
+	"readyz":  true,
+}
+
+// user determines the user issuing the request.
+func (set *settings) user(r *http.Request) (string, error) {
+	if set.sessions != nil {
+		if c, err := r.Cookie(sessionCookie); err == nil {
+			if user, ok := set.sessions.verify(c.Value, time.Now()); ok {
+				return user, nil
+			}
+		}
+	}
+	return set.auth.Authenticate(r)
+}
+
+// authenticate determines the user issuing the request. It returns false if
+// the user is not allowed to access the requested command, in which case a
+// response has been sent already.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request, set *settings, cmd string) (string, bool) {
+	if set.auth == nil {
+		return "", true
+	}
+
+	user, err := set.user(r)
+	if err != nil {
+		log.Printf("Authentication failed: %v", err)
+	}
+	if user != "" || public[cmd] {
+		return user, true
+	}
+
+	if set.sessions != nil {
+		if r.Method == "GET" {
+			http.Redirect(w, r, s.Root()+"login?next="+url.QueryEscape(r.RequestURI),
+				http.StatusSeeOther)
+			return "", false
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="SysDB"`)
+	}
+	s.err(w, http.StatusUnauthorized, errors.New("Authentication required"))
+	return "", false
+}
+
+// login serves the login form for password authenticators.
+func (s *Server) login(w http.ResponseWriter, req request) {
+	set := s.settings()
+	p := struct {
+		Enabled, Password bool
+		User, Next, Error string
+	}{
+		Enabled:  set.auth != nil,
+		Password: set.sessions != nil,
+		User:     req.user,
+		Next:     localTarget(req.r.FormValue("next"), s.Root()),
+	}
+
+	status := http.StatusOK
+	if p.Password && req.r.Method == "POST" {
+		user := req.r.PostFormValue("user")
+		if set.auth.(PasswordAuthenticator).CheckPassword(user, req.r.PostFormValue("password")) {
+			expires := time.Now().Add(sessionLifetime)
+			http.SetCookie(w, &http.Cookie{
+				Name:     sessionCookie,
+				Value:    set.sessions.issue(user, expires),
+				Path:     s.Root(),
+				Expires:  expires,
+				Secure:   req.r.TLS != nil,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+			http.Redirect(w, req.r, p.Next, http.StatusSeeOther)
+			return
+		}
+		log.Printf("Login failed for user %q", user)
+		p.Error = "Invalid user name or password"
+		status = http.StatusUnauthorized
+	}
+
+	page, err := tmpl(s.result(req.inst, "login"), &p)
+	if err != nil {
+		s.internal(w, err)
+		return
+	}
+	page.Title = "Login"
+	page.User = req.user
+	s.render(w, nil, status, page)
+}
+
+// localTarget returns next if it refers to a page below root on the same
+// server, root otherwise. It guards against redirecting users to other sites
+// after logging in.
+func localTarget(next, root string) string {
+	// Browsers treat '\' like '/' and ignore tabs and newlines in URLs.
+	for i := 0; i < len(next); i++ {
+		if next[i] == '\\' || next[i] < 0x20 || next[i] == 0x7f {
+			return root
+		}
+	}
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil || u.Opaque != "" ||
+		strings.HasPrefix(next, "//") || !strings.HasPrefix(u.Path, "/") {
+		return root
+	}
+
+	p := path.Clean(u.Path)
+	if p != "/" && strings.HasSuffix(u.Path, "/") {
+		p += "/"
+	}
+	if p != strings.TrimSuffix(root, "/") && !strings.HasPrefix(p, root) {
+		return root
+	}
+	target := &url.URL{Path: p, RawQuery: u.RawQuery}
+	return target.String()
+}
+
+// logout ends the user's session. All sessions of the user are revoked such
+// that copies of the session cookie become invalid as well. It only accepts
+// POST requests carrying the CSRF token such that other sites cannot log out
+// users.
+func (s *Server) logout(w http.ResponseWriter, req request) {
+	set := s.settings()
+	if set.sessions != nil {
+		if req.user != "" {
+			set.sessions.revoke(req.user)
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     sessionCookie,
+			Path:     s.Root(),
+			MaxAge:   -1,
+			HttpOnly: true,
+		})
+	}
+
+	p := struct{ Enabled, Password bool }{
+		Enabled:  set.auth != nil,
+		Password: set.sessions != nil,
+	}
+	page, err := tmpl(s.result(req.inst, "logout"), &p)
+	if err != nil {
+		s.internal(w, err)
+		return
+	}
+	page.Title = "Logout"
+	s.render(w, nil, http.StatusOK, page)
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
@@ -0,0 +1,201 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHtpasswd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	content := "# comment\n" +
+		"apr1:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0\n" +
+		"apr1long:$apr1$ab$yUyD9rKpmuUoUfW1r6oYC/\n" +
+		"sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := NewHtpasswd(path)
+	if err != nil {
+		t.Fatalf("NewHtpasswd() = %v", err)
+	}
+	for _, test := range []struct {
+		user, password string
+		want           bool
+	}{
+		{"apr1", "secret", true},
+		{"apr1", "Secret", false},
+		{"apr1long", "p@ss word with a long text", true},
+		{"sha", "secret", true},
+		{"sha", "", false},
+		{"unknown", "secret", false},
+	} {
+		if got := h.CheckPassword(test.user, test.password); got != test.want {
+			t.Errorf("CheckPassword(%q, %q) = %v; want %v",
+				test.user, test.password, got, test.want)
+		}
+	}
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("sha", "secret")
+	if user, err := h.Authenticate(r); user != "sha" || err != nil {
+		t.Errorf("Authenticate(sha:secret) = %q, %v; want \"sha\", <nil>", user, err)
+	}
+	r.SetBasicAuth("sha", "wrong")
+	if user, err := h.Authenticate(r); user != "" || err == nil {
+		t.Errorf("Authenticate(sha:wrong) = %q, %v; want \"\", <error>", user, err)
+	}
+
+	if err := os.WriteFile(path, []byte("plain:secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Reload(); err == nil {
+		t.Errorf("Reload() accepted plain-text password")
+	}
+	bcrypt := "bcrypt:$2y$05$c4WoMPo3SXsafkva.HHa6uXQZWr7oboPiC2bT/r7q1BB8I2s0BRqC\n"
+	if err := os.WriteFile(path, []byte(bcrypt), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Reload(); err == nil {
+		t.Errorf("Reload() accepted unsupported bcrypt hash")
+	}
+}
+
+func TestProxyHeader(t *testing.T) {
+	_, n, _ := net.ParseCIDR("10.0.0.0/8")
+	p := &ProxyHeader{Header: "X-Remote-User", Trusted: []*net.IPNet{n}}
+
+	for _, test := range []struct {
+		addr, user string
+		want       string
+		wantErr    bool
+	}{
+		{"10.1.2.3:1234", "alice", "alice", false},
+		{"10.1.2.3:1234", "", "", false},
+		{"192.168.1.1:1234", "alice", "", true},
+		{"unix:", "alice", "", true},
+		{"@", "alice", "", true},
+	} {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.addr
+		if test.user != "" {
+			r.Header.Set("X-Remote-User", test.user)
+		}
+		user, err := p.Authenticate(r)
+		if user != test.want || (err != nil) != test.wantErr {
+			t.Errorf("Authenticate(%s, %q) = %q, %v; want %q (error: %v)",
+				test.addr, test.user, user, err, test.want, test.wantErr)
+		}
+	}
+
+	// Requests received on Unix sockets carry no client address.
+	local := &net.UnixAddr{Name: "/run/webui.sock", Net: "unix"}
+	for _, trust := range []bool{false, true} {
+		p.Unix = trust
+		r, _ := http.NewRequest("GET", "/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, local))
+		r.RemoteAddr = "@"
+		r.Header.Set("X-Remote-User", "alice")
+		user, err := p.Authenticate(r)
+		if trust && (user != "alice" || err != nil) {
+			t.Errorf("Authenticate(unix) = %q, %v; want \"alice\"", user, err)
+		}
+		if !trust && (user != "" || err == nil) {
+			t.Errorf("Authenticate(unix) = %q, %v; want error", user, err)
+		}
+	}
+}
+
+func TestLocalTarget(t *testing.T) {
+	for _, test := range []struct {
+		next, root, want string
+	}{
+		{"", "/", "/"},
+		{"/hosts", "/", "/hosts"},
+		{"/host/a?x=1", "/", "/host/a?x=1"},
+		{"/eu/hosts/", "/", "/eu/hosts/"},
+		{"/sysdb/hosts", "/sysdb/", "/sysdb/hosts"},
+		{"/sysdb", "/sysdb/", "/sysdb"},
+		{"/other", "/sysdb/", "/sysdb/"},
+		{"/sysdb/../other", "/sysdb/", "/sysdb/"},
+		{"//evil.example", "/", "/"},
+		{"/\\evil.example", "/", "/"},
+		{"/\t/evil.example", "/", "/"},
+		{"https://evil.example/", "/", "/"},
+		{"javascript:alert(1)", "/", "/"},
+		{"hosts", "/", "/"},
+	} {
+		if got := localTarget(test.next, test.root); got != test.want {
+			t.Errorf("localTarget(%q, %q) = %q; want %q", test.next, test.root, got, test.want)
+		}
+	}
+}
+
+func TestSessions(t *testing.T) {
+	s := &sessions{key: []byte("0123456789abcdef")}
+	now := time.Now()
+	token := s.issue("alice.example", now.Add(time.Hour))
+
+	if user, ok := s.verify(token, now); !ok || user != "alice.example" {
+		t.Errorf("verify(%q) = %q, %v; want \"alice.example\", true", token, user, ok)
+	}
+	if user, ok := s.verify(token, now.Add(2*time.Hour)); ok {
+		t.Errorf("verify(%q) = %q, %v for expired token; want false", token, user, ok)
+	}
+	bad := token[:len(token)-1] + "0"
+	if token[len(token)-1] == '0' {
+		bad = token[:len(token)-1] + "1"
+	}
+	if user, ok := s.verify(bad, now); ok {
+		t.Errorf("verify(%q) = %q, %v for invalid signature; want false", bad, user, ok)
+	}
+	other := &sessions{key: []byte("fedcba9876543210")}
+	if user, ok := other.verify(token, now); ok {
+		t.Errorf("verify(%q) = %q, %v with different key; want false", token, user, ok)
+	}
+
+	bob := s.issue("bob", now.Add(time.Hour))
+	s.revoke("alice.example")
+	if user, ok := s.verify(token, now); ok {
+		t.Errorf("verify(%q) = %q, %v for revoked token; want false", token, user, ok)
+	}
+	if user, ok := s.verify(bob, now); !ok || user != "bob" {
+		t.Errorf("verify(%q) = %q, %v; want \"bob\", true", bob, user, ok)
+	}
+	token = s.issue("alice.example", now.Add(time.Hour))
+	if user, ok := s.verify(token, now); !ok || user != "alice.example" {
+		t.Errorf("verify(%q) = %q, %v after new login; want \"alice.example\", true", token, user, ok)
+	}
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
@@ -0,0 +1,278 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+// Caching of SysDB query results.
+//
+// Results are cached by SysDB user and query string. Concurrent identical
+// queries are coalesced such that they share a single round trip to SysDB.
+// Errors are never cached. Cached results are shared between requests and
+// must not be modified.
+
+import (
+	"container/list"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CacheConfig specifies the query cache settings.
+type CacheConfig struct {
+	// Size specifies the maximum number of cached results. Caching is
+	// disabled if zero.
+	Size int
+
+	// TTL specifies how long results are cached by kind of query (FETCH,
+	// LIST, LOOKUP, TIMESERIES). Results of other queries are not cached.
+	TTL map[string]time.Duration
+
+	// LiveTTL specifies how long results of TIMESERIES queries ending at the
+	// current time are cached.
+	LiveTTL time.Duration
+}
+
+// A cache is an LRU cache of query results.
+type cache struct {
+	cfg CacheConfig
+
+	mu       sync.Mutex
+	lru      *list.List
+	entries  map[string]*list.Element
+	inflight map[string]*call
+
+	hits, misses, coalesced, evictions uint64
+}
+
+type cacheEntry struct {
+	key     string
+	kind    string
+	res     interface{}
+	expires time.Time
+}
+
+// A call is an in-flight query.
+type call struct {
+	done chan struct{}
+	res  interface{}
+	err  error
+}
+
+func newCache(cfg CacheConfig) *cache {
+	if cfg.Size <= 0 {
+		return nil
+	}
+	return &cache{
+		cfg:      cfg,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		inflight: make(map[string]*call),
+	}
+}
+
+// query returns the cached result of a query or executes it using the
+// specified function. Results are cached separately for each scope (e.g. a
+// SysDB instance and user). A ttl of zero selects the configured TTL of the
+// kind of query.
+func (c *cache) query(scope, q string, ttl time.Duration, m *metrics,
+	f func(string) (interface{}, error)) (interface{}, error) {
+	kind := queryKind(q)
+	if ttl == 0 {
+		ttl = c.cfg.TTL[kind]
+	}
+	if ttl <= 0 {
+		return f(q)
+	}
+	key := scope + "\x00" + q
+
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*cacheEntry)
+		if time.Now().Before(entry.expires) {
+			c.lru.MoveToFront(e)
+			c.hits++
+			c.mu.Unlock()
+			m.cache("hit")
+			return entry.res, nil
+		}
+		c.remove(e)
+	}
+	if cl, ok := c.inflight[key]; ok {
+		c.coalesced++
+		c.mu.Unlock()
+		m.cache("coalesced")
+		<-cl.done
+		return cl.res, cl.err
+	}
+	cl := &call{done: make(chan struct{})}
+	c.inflight[key] = cl
+	c.misses++
+	c.mu.Unlock()
+	m.cache("miss")
+
+	// Release waiting callers even if f panics.
+	cl.err = errors.New("Query aborted")
+	defer func() {
+		c.mu.Lock()
+		delete(c.inflight, key)
+		if cl.err == nil {
+			c.add(&cacheEntry{key: key, kind: kind, res: cl.res, expires: time.Now().Add(ttl)})
+		}
+		c.mu.Unlock()
+		close(cl.done)
+	}()
+
+	cl.res, cl.err = f(q)
+	return cl.res, cl.err
+}
+
+func (c *cache) add(entry *cacheEntry) {
+	if e, ok := c.entries[entry.key]; ok {
+		c.remove(e)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.cfg.Size {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+}
+
+func (c *cache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*cacheEntry).key)
+}
+
+// flush removes all cached results.
+func (c *cache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// len returns the number of cached results.
+func (c *cache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// cacheStats describes the state of the cache.
+type cacheStats struct {
+	Enabled bool
+	Size    int
+	Entries int
+	Kinds   []kindStats
+	TTLs    []kindTTL
+	LiveTTL time.Duration
+
+	Hits, Misses, Coalesced, Evictions uint64
+	HitRate                            float64
+}
+
+type kindStats struct {
+	Kind    string
+	Entries int
+}
+
+type kindTTL struct {
+	Kind string
+	TTL  time.Duration
+}
+
+func (c *cache) stats() *cacheStats {
+	if c == nil {
+		return &cacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	st := &cacheStats{
+		Enabled:   true,
+		Size:      c.cfg.Size,
+		Entries:   c.lru.Len(),
+		LiveTTL:   c.cfg.LiveTTL,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Coalesced: c.coalesced,
+		Evictions: c.evictions,
+	}
+	if total := c.hits + c.misses + c.coalesced; total > 0 {
+		st.HitRate = float64(c.hits+c.coalesced) / float64(total) * 100
+	}
+
+	kinds := make(map[string]int)
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		kinds[e.Value.(*cacheEntry).kind]++
+	}
+	for k, n := range kinds {
+		st.Kinds = append(st.Kinds, kindStats{k, n})
+	}
+	sort.Slice(st.Kinds, func(i, j int) bool { return st.Kinds[i].Kind < st.Kinds[j].Kind })
+	for k, ttl := range c.cfg.TTL {
+		st.TTLs = append(st.TTLs, kindTTL{k, ttl})
+	}
+	sort.Slice(st.TTLs, func(i, j int) bool { return st.TTLs[i].Kind < st.TTLs[j].Kind })
+	return st
+}
+
+// cachePage shows the cache statistics. POST requests of administrators with
+// action=flush remove all cached results.
+func cachePage(req request, s *Server) (*page, error) {
+	admin := req.user != "" && s.settings().admins[req.user]
+	if req.r.Method == "POST" && req.r.PostFormValue("action") == "flush" {
+		if !admin {
+			return nil, errors.New("Only administrators may flush the cache")
+		}
+		if s.cache != nil {
+			s.cache.flush()
+		}
+	}
+	p := struct {
+		*cacheStats
+		Admin bool
+	}{s.cache.stats(), admin}
+	return tmpl(s.result(req.inst, "cache"), &p)
+}
+
+// isLive determines whether a time range ending at the specified time shows
+// current data.
+func (c *cache) isLive(end time.Time) bool {
+	return c != nil && c.cfg.LiveTTL > 0 && time.Since(end) < c.cfg.LiveTTL
+}
+
+// align shifts a time range ending at the current time such that it ends at
+// a multiple of the live TTL. This allows concurrent requests to share
+// cached results.
+func (c *cache) align(start, end time.Time) (time.Time, time.Time) {
+	d := end.Sub(end.Truncate(c.cfg.LiveTTL))
+	return start.Add(-d), end.Add(-d)
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
@@ -0,0 +1,159 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	c := newCache(CacheConfig{
+		Size: 2,
+		TTL:  map[string]time.Duration{"LIST": time.Hour, "FETCH": time.Hour},
+	})
+	calls := 0
+	f := func(q string) (interface{}, error) {
+		calls++
+		if q == "FETCH host 'err'" {
+			return nil, errors.New("failed")
+		}
+		return q, nil
+	}
+
+	for _, test := range []struct {
+		user, q   string
+		wantCalls int
+	}{
+		{"", "LIST hosts", 1},
+		{"", "LIST hosts", 1},
+		// Results are cached per SysDB user.
+		{"alice", "LIST hosts", 2},
+		// Not cached (no TTL).
+		{"", "LOOKUP hosts MATCHING name = 'a'", 3},
+		{"", "LOOKUP hosts MATCHING name = 'a'", 4},
+		// Errors are not cached.
+		{"", "FETCH host 'err'", 5},
+		{"", "FETCH host 'err'", 6},
+		// Evicts the least recently used entry ("", "LIST hosts").
+		{"", "FETCH host 'a'", 7},
+		{"alice", "LIST hosts", 7},
+		{"", "LIST hosts", 8},
+	} {
+		res, err := c.query(test.user, test.q, 0, nil, f)
+		if calls != test.wantCalls {
+			t.Errorf("query(%q, %q): %d calls; want %d", test.user, test.q, calls, test.wantCalls)
+		}
+		if err == nil && res != test.q {
+			t.Errorf("query(%q, %q) = %v; want %q", test.user, test.q, res, test.q)
+		}
+	}
+	if st := c.stats(); st.Entries != 2 || st.Evictions != 2 {
+		t.Errorf("stats() = %d entries, %d evictions; want 2, 2", st.Entries, st.Evictions)
+	}
+
+	// Expired results.
+	if _, err := c.query("", "LIST services", time.Nanosecond, nil, f); err != nil {
+		t.Fatalf("query(LIST services) = %v", err)
+	}
+	time.Sleep(time.Millisecond)
+	c.query("", "LIST services", time.Nanosecond, nil, f)
+	if calls != 10 {
+		t.Errorf("query(LIST services): %d calls; want 10", calls)
+	}
+}
+
+func TestCacheCoalescing(t *testing.T) {
+	c := newCache(CacheConfig{Size: 10, TTL: map[string]time.Duration{"LIST": time.Hour}})
+	release := make(chan struct{})
+	var mu sync.Mutex
+	calls := 0
+	f := func(q string) (interface{}, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		<-release
+		return q, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.query("", "LIST hosts", 0, nil, f)
+		}()
+	}
+	// Wait for all queries to be in flight.
+	for {
+		c.mu.Lock()
+		n := c.misses + c.coalesced
+		c.mu.Unlock()
+		if n == 5 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("Concurrent queries: %d calls; want 1", calls)
+	}
+}
+
+func TestCachePanic(t *testing.T) {
+	c := newCache(CacheConfig{Size: 10, TTL: map[string]time.Duration{"LIST": time.Hour}})
+	func() {
+		defer func() { recover() }()
+		c.query("", "LIST hosts", 0, nil, func(string) (interface{}, error) {
+			panic("boom")
+		})
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		res, err := c.query("", "LIST hosts", 0, nil, func(q string) (interface{}, error) {
+			return q, nil
+		})
+		if res != "LIST hosts" || err != nil {
+			t.Errorf("query() after panic = %v, %v; want \"LIST hosts\", <nil>", res, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("query() blocked after a panicking query")
+	}
+	if n := c.len(); n != 1 {
+		t.Errorf("len() = %d; want 1", n)
+	}
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
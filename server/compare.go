@@ -0,0 +1,180 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+// Helper functions for comparing hosts.
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sysdb/go/sysdb"
+)
+
+// A cell is a single object's value in a comparison.
+type cell struct {
+	Value   string
+	Present bool
+
+	// LastUpdate is the time of the last update of the object. Stale
+	// objects have not been updated for more than two update intervals
+	// compared to the most recently updated object of the same name.
+	LastUpdate time.Time
+	Stale      bool
+
+	interval time.Duration
+}
+
+// A diffRow compares a named object across a list of hosts.
+type diffRow struct {
+	Name    string
+	Cells   []cell
+	Differs bool
+}
+
+type comparison struct {
+	Hosts      []string
+	Columns    int
+	Attributes []diffRow
+	Services   []diffRow
+	Metrics    []diffRow
+}
+
+func compare(req request, s *Server) (*page, error) {
+	names := append([]string{}, req.params["hosts"]...)
+	names = append(names, req.r.Form["with"]...)
+
+	var hosts []*sysdb.Host
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		h, err := req.id.fetchHost(name)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, h)
+	}
+	if len(hosts) < 2 {
+		return nil, errors.New("Need at least two hosts to compare")
+	}
+	return tmpl(s.result(req.inst, "compare"), compareHosts(hosts))
+}
+
+// compareHosts builds a side-by-side comparison of the specified hosts'
+// attributes, services, and metrics. Services and metrics are compared by
+// their attributes; all objects are compared by their last update.
+func compareHosts(hosts []*sysdb.Host) *comparison {
+	c := &comparison{Columns: len(hosts) + 1}
+	attrs := make([]map[string]cell, len(hosts))
+	services := make([]map[string]cell, len(hosts))
+	metrics := make([]map[string]cell, len(hosts))
+	for i, h := range hosts {
+		c.Hosts = append(c.Hosts, h.Name)
+		attrs[i] = make(map[string]cell)
+		for _, a := range h.Attributes {
+			attrs[i][a.Name] = newCell(a.Value, a.LastUpdate, a.UpdateInterval)
+		}
+		services[i] = make(map[string]cell)
+		for _, s := range h.Services {
+			services[i][s.Name] = newCell(attrSummary(s.Attributes), s.LastUpdate, s.UpdateInterval)
+		}
+		metrics[i] = make(map[string]cell)
+		for _, m := range h.Metrics {
+			metrics[i][m.Name] = newCell(attrSummary(m.Attributes), m.LastUpdate, m.UpdateInterval)
+		}
+	}
+
+	c.Attributes = diff(attrs)
+	c.Services = diff(services)
+	c.Metrics = diff(metrics)
+	return c
+}
+
+func newCell(value string, last sysdb.Time, interval sysdb.Duration) cell {
+	return cell{
+		Value:      value,
+		Present:    true,
+		LastUpdate: time.Time(last),
+		interval:   time.Duration(interval),
+	}
+}
+
+// attrSummary formats a list of attributes as "name=value" pairs sorted by
+// name.
+func attrSummary(attrs []sysdb.Attribute) string {
+	pairs := make([]string, len(attrs))
+	for i, a := range attrs {
+		pairs[i] = a.Name + "=" + a.Value
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+// diff compares the objects of multiple hosts. Each map assigns object
+// names to the object of one host. The result is sorted by name.
+func diff(objs []map[string]cell) []diffRow {
+	var names []string
+	seen := make(map[string]bool)
+	for _, o := range objs {
+		for name := range o {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	rows := make([]diffRow, 0, len(names))
+	for _, name := range names {
+		row := diffRow{Name: name}
+		var newest time.Time
+		for i, o := range objs {
+			c := o[name]
+			row.Cells = append(row.Cells, c)
+			if i > 0 && (c.Present != row.Cells[0].Present || c.Value != row.Cells[0].Value) {
+				row.Differs = true
+			}
+			if c.LastUpdate.After(newest) {
+				newest = c.LastUpdate
+			}
+		}
+		for i, c := range row.Cells {
+			if c.Present && c.interval > 0 && !c.LastUpdate.IsZero() &&
+				newest.Sub(c.LastUpdate) > 2*c.interval {
+				row.Cells[i].Stale = true
+				row.Differs = true
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
@@ -0,0 +1,158 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sysdb/go/sysdb"
+)
+
+func TestCompareHosts(t *testing.T) {
+	at := func(min int) sysdb.Time {
+		return sysdb.Time(time.Date(2014, 12, 1, 13, min, 0, 0, time.UTC))
+	}
+	minute := sysdb.Duration(time.Minute)
+	a := &sysdb.Host{
+		Name: "a",
+		Attributes: []sysdb.Attribute{
+			{Name: "arch", Value: "amd64", LastUpdate: at(50), UpdateInterval: minute},
+			{Name: "os", Value: "Linux", LastUpdate: at(50), UpdateInterval: minute},
+		},
+		Services: []sysdb.Service{
+			{Name: "ntpd", LastUpdate: at(50), UpdateInterval: minute},
+			{Name: "sshd", LastUpdate: at(50), UpdateInterval: minute,
+				Attributes: []sysdb.Attribute{{Name: "port", Value: "22"}}},
+		},
+		Metrics: []sysdb.Metric{{Name: "load", LastUpdate: at(50), UpdateInterval: minute}},
+	}
+	b := &sysdb.Host{
+		Name: "b",
+		Attributes: []sysdb.Attribute{
+			{Name: "arch", Value: "amd64", LastUpdate: at(49), UpdateInterval: minute},
+			{Name: "os", Value: "FreeBSD", LastUpdate: at(50), UpdateInterval: minute},
+		},
+		Services: []sysdb.Service{
+			{Name: "ntpd", LastUpdate: at(50), UpdateInterval: minute},
+			{Name: "sshd", LastUpdate: at(50), UpdateInterval: minute,
+				Attributes: []sysdb.Attribute{{Name: "port", Value: "2222"}}},
+		},
+		Metrics: []sysdb.Metric{{Name: "load", LastUpdate: at(40), UpdateInterval: minute}},
+	}
+	c := compareHosts([]*sysdb.Host{a, b})
+
+	differs := func(rows []diffRow) map[string]bool {
+		m := make(map[string]bool)
+		for _, r := range rows {
+			m[r.Name] = r.Differs
+		}
+		return m
+	}
+	for _, test := range []struct {
+		kind string
+		rows []diffRow
+		want map[string]bool
+	}{
+		{"attributes", c.Attributes, map[string]bool{"arch": false, "os": true}},
+		{"services", c.Services, map[string]bool{"ntpd": false, "sshd": true}},
+		{"metrics", c.Metrics, map[string]bool{"load": true}},
+	} {
+		if got := differs(test.rows); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("compareHosts(): %s differ: %v; want %v", test.kind, got, test.want)
+		}
+	}
+
+	if v := c.Services[1].Cells[1].Value; v != "port=2222" {
+		t.Errorf("compareHosts(): sshd of b = %q; want port=2222", v)
+	}
+	if cells := c.Metrics[0].Cells; cells[0].Stale || !cells[1].Stale {
+		t.Errorf("compareHosts(): load stale = %v, %v; want false, true", cells[0].Stale, cells[1].Stale)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	now := time.Date(2014, 12, 1, 13, 37, 0, 0, time.UTC)
+	for _, test := range []struct {
+		objs []map[string]cell
+		want []diffRow
+	}{
+		{
+			objs: []map[string]cell{
+				{"x": {Value: "1", Present: true}},
+				{"x": {Value: "1", Present: true}},
+			},
+			want: []diffRow{{Name: "x", Cells: []cell{{Value: "1", Present: true}, {Value: "1", Present: true}}}},
+		},
+		{
+			objs: []map[string]cell{
+				{"x": {Value: "1", Present: true}},
+				{},
+			},
+			want: []diffRow{{Name: "x", Cells: []cell{{Value: "1", Present: true}, {}}, Differs: true}},
+		},
+		{
+			objs: []map[string]cell{
+				{"y": {Value: "1", Present: true}},
+				{"x": {Value: "2", Present: true}, "y": {Value: "2", Present: true}},
+			},
+			want: []diffRow{
+				{Name: "x", Cells: []cell{{}, {Value: "2", Present: true}}, Differs: true},
+				{Name: "y", Cells: []cell{{Value: "1", Present: true}, {Value: "2", Present: true}}, Differs: true},
+			},
+		},
+		{
+			// Without an update interval, update times are not compared.
+			objs: []map[string]cell{
+				{"x": {Present: true, LastUpdate: now}},
+				{"x": {Present: true, LastUpdate: now.Add(-time.Hour)}},
+			},
+			want: []diffRow{{Name: "x", Cells: []cell{
+				{Present: true, LastUpdate: now},
+				{Present: true, LastUpdate: now.Add(-time.Hour)},
+			}}},
+		},
+		{
+			objs: []map[string]cell{
+				{"x": {Present: true, LastUpdate: now, interval: time.Minute}},
+				{"x": {Present: true, LastUpdate: now.Add(-2 * time.Minute), interval: time.Minute}},
+				{"x": {Present: true, LastUpdate: now.Add(-3 * time.Minute), interval: time.Minute}},
+			},
+			want: []diffRow{{Name: "x", Cells: []cell{
+				{Present: true, LastUpdate: now, interval: time.Minute},
+				{Present: true, LastUpdate: now.Add(-2 * time.Minute), interval: time.Minute},
+				{Present: true, LastUpdate: now.Add(-3 * time.Minute), interval: time.Minute, Stale: true},
+			}, Differs: true}},
+		},
+	} {
+		if got := diff(test.objs); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("diff(%v) = %+v; want %+v", test.objs, got, test.want)
+		}
+	}
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
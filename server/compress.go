@@ -0,0 +1,235 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+// HTTP middleware compressing responses.
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Supported content codings in order of preference.
+var encodings = []struct {
+	name   string
+	writer func(io.Writer) io.WriteCloser
+}{
+	{"gzip", func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }},
+	{"deflate", func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }},
+}
+
+// compressible lists media types worth compressing. Anything else (e.g.
+// PNG images or archives) usually is compressed already.
+var compressible = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/x-yaml",
+	"image/svg+xml",
+}
+
+// Compress returns a handler which compresses responses of h using gzip or
+// deflate, depending on the encodings accepted by the client. Responses
+// smaller than minSize bytes and responses of types which are not
+// compressible are sent unmodified.
+func Compress(h http.Handler, minSize int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		enc := negotiate(r.Header.Get("Accept-Encoding"))
+		if enc < 0 || r.Method == http.MethodHead {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, enc: enc, minSize: minSize}
+		defer cw.close()
+		h.ServeHTTP(cw, r)
+	})
+}
+
+// negotiate selects the preferred encoding accepted according to the
+// specified Accept-Encoding header. It returns the index of the encoding or
+// -1 if none of the supported encodings is acceptable.
+func negotiate(accept string) int {
+	best, bestQ := -1, 0.0
+	qs := make(map[string]float64)
+	for _, e := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(e, ";")
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+			if ok && strings.EqualFold(k, "q") {
+				var err error
+				if q, err = strconv.ParseFloat(v, 64); err != nil {
+					q = 0
+				}
+			}
+		}
+		qs[strings.ToLower(strings.TrimSpace(name))] = q
+	}
+	for i, enc := range encodings {
+		q, ok := qs[enc.name]
+		if !ok {
+			q = qs["*"]
+		}
+		if q > bestQ {
+			best, bestQ = i, q
+		}
+	}
+	return best
+}
+
+func isCompressible(contentType string) bool {
+	typ, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasSuffix(typ, "+json") || strings.HasSuffix(typ, "+xml") {
+		return true
+	}
+	for _, c := range compressible {
+		if typ == c || strings.HasSuffix(c, "/") && strings.HasPrefix(typ, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// A compressWriter buffers the beginning of a response until it knows
+// whether to compress it.
+type compressWriter struct {
+	http.ResponseWriter
+	enc     int
+	minSize int
+
+	status  int
+	buf     []byte
+	decided bool
+	w       io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	if status != http.StatusOK {
+		// Skip errors, partial content, and responses without a body.
+		w.start(false)
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < w.minSize {
+			return len(b), nil
+		}
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.w != nil {
+		return w.w.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// start sends the response header and any buffered data. The response is
+// compressed if compress is set and the response qualifies.
+func (w *compressWriter) start(compress bool) error {
+	w.decided = true
+	h := w.Header()
+	if h.Get("Content-Type") == "" && len(w.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+	if compress && h.Get("Content-Encoding") == "" && isCompressible(h.Get("Content-Type")) {
+		enc := encodings[w.enc]
+		h.Set("Content-Encoding", enc.name)
+		h.Del("Content-Length")
+		// The compressed representation is semantically equivalent.
+		if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+			h.Set("ETag", "W/"+etag)
+		}
+		w.w = enc.writer(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	var err error
+	if len(w.buf) > 0 {
+		if w.w != nil {
+			_, err = w.w.Write(w.buf)
+		} else {
+			_, err = w.ResponseWriter.Write(w.buf)
+		}
+	}
+	w.buf = nil
+	return err
+}
+
+// Flush sends all data written so far to the client.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.start(len(w.buf) > 0 && len(w.buf) >= w.minSize)
+	}
+	if f, ok := w.w.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressWriter) close() {
+	if !w.decided {
+		if w.status == 0 {
+			// Nothing has been written at all; let net/http handle it.
+			return
+		}
+		// The response is smaller than the threshold.
+		w.start(false)
+	}
+	if w.w != nil {
+		w.w.Close()
+	}
+}
+
+// Unwrap provides access to the underlying writer for http.ResponseController.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
@@ -0,0 +1,114 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	for _, test := range []struct {
+		accept string
+		want   int
+	}{
+		{"", -1},
+		{"gzip", 0},
+		{"deflate", 1},
+		{"gzip, deflate, br", 0},
+		{"gzip;q=0.5, deflate", 1},
+		{"gzip;q=0, deflate;q=0", -1},
+		{"*", 0},
+		{"*;q=0.1, gzip;q=0", 1},
+		{"identity", -1},
+		{"GZIP", 0},
+	} {
+		if got := negotiate(test.accept); got != test.want {
+			t.Errorf("negotiate(%q) = %d; want %d", test.accept, got, test.want)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	large := strings.Repeat("<p>SysDB</p>", 200)
+	for _, test := range []struct {
+		contentType string
+		body        string
+		status      int
+		want        string
+	}{
+		{"text/html; charset=utf-8", large, http.StatusOK, "gzip"},
+		{"image/svg+xml", large, http.StatusOK, "gzip"},
+		{"application/json", large, http.StatusOK, "gzip"},
+		{"", large, http.StatusOK, "gzip"},
+		{"text/html; charset=utf-8", "<p>SysDB</p>", http.StatusOK, ""},
+		{"image/png", large, http.StatusOK, ""},
+		{"text/html; charset=utf-8", large, http.StatusNotFound, ""},
+	} {
+		h := Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if test.contentType != "" {
+				w.Header().Set("Content-Type", test.contentType)
+			}
+			w.WriteHeader(test.status)
+			io.WriteString(w, test.body)
+		}), 1024)
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if got := w.Header().Get("Content-Encoding"); got != test.want {
+			t.Errorf("Compress(%q, %d bytes) encoding = %q; want %q",
+				test.contentType, len(test.body), got, test.want)
+			continue
+		}
+		if w.Code != test.status {
+			t.Errorf("Compress(%q, %d bytes) status = %d; want %d",
+				test.contentType, len(test.body), w.Code, test.status)
+		}
+		var body io.Reader = w.Body
+		if test.want == "gzip" {
+			zr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Errorf("Compress(%q, %d bytes) returned invalid gzip data: %v",
+					test.contentType, len(test.body), err)
+				continue
+			}
+			body = zr
+		}
+		if got, err := io.ReadAll(body); err != nil || string(got) != test.body {
+			t.Errorf("Compress(%q, %d bytes) = %d bytes (%v); want %d bytes",
+				test.contentType, len(test.body), len(got), err, len(test.body))
+		}
+	}
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
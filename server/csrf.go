@@ -0,0 +1,157 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+// Protection against cross-site request forgery and security headers.
+//
+// Each browser receives a random CSRF cookie. Forms include a token derived
+// from the cookie using a secret key of the server. Requests using methods
+// other than GET and HEAD are rejected unless they carry a valid token,
+// either in a form field or in the X-CSRF-Token header.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	csrfCookie = "sysdb_csrf"
+	csrfField  = "csrf_token"
+	// csrfHeader carries the token of the current client in responses and
+	// may be used to pass on the token in requests.
+	csrfHeader = "X-CSRF-Token"
+
+	// csrfPlaceholder is replaced with the actual token when rendering a
+	// page. Template output never includes NUL bytes otherwise since they
+	// are escaped by html/template.
+	csrfPlaceholder = "\x00csrf\x00"
+)
+
+// DefaultHeaders lists the security headers sent with all responses by
+// default. The origin of an absolute logo URL (see Branding) is added to the
+// img-src directive of the Content-Security-Policy.
+var DefaultHeaders = map[string]string{
+	"Content-Security-Policy": "default-src 'self'; style-src 'self' 'unsafe-inline'; " +
+		"img-src 'self' data:; object-src 'none'; base-uri 'none'; " +
+		"form-action 'self'; frame-ancestors 'none'",
+	"X-Frame-Options":        "DENY",
+	"X-Content-Type-Options": "nosniff",
+	"Referrer-Policy":        "same-origin",
+}
+
+// allowImages adds the origin of an absolute URL to the img-src directive of
+// a Content-Security-Policy. The policy is returned unmodified if the URL is
+// relative or the policy has no img-src directive.
+func allowImages(csp, rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" {
+		return csp
+	}
+	origin := u.Host
+	if u.Scheme != "" {
+		origin = u.Scheme + "://" + u.Host
+	}
+
+	directives := strings.Split(csp, ";")
+	for i, d := range directives {
+		fields := strings.Fields(d)
+		if len(fields) == 0 || strings.ToLower(fields[0]) != "img-src" {
+			continue
+		}
+		for _, src := range fields[1:] {
+			if src == origin || src == "*" {
+				return csp
+			}
+		}
+		directives[i] = strings.TrimRight(d, " ") + " " + origin
+		return strings.Join(directives, ";")
+	}
+	return csp
+}
+
+// csrfInput returns a hidden form field carrying the CSRF token. It's
+// available to templates as the "csrf" function.
+func csrfInput() template.HTML {
+	return template.HTML(`<input type="hidden" name="` + csrfField + `" value="` + csrfPlaceholder + `" />`)
+}
+
+func newCSRFKey() ([]byte, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	return key, err
+}
+
+// csrfToken returns the CSRF token of the client, issuing a new cookie if
+// the request does not carry a valid one.
+func (s *Server) csrfToken(w http.ResponseWriter, r *http.Request) string {
+	var value string
+	if c, err := r.Cookie(csrfCookie); err == nil && len(c.Value) == 32 {
+		if _, err := hex.DecodeString(c.Value); err == nil {
+			value = c.Value
+		}
+	}
+	if value == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return ""
+		}
+		value = hex.EncodeToString(b)
+		http.SetCookie(w, &http.Cookie{
+			Name:     csrfCookie,
+			Value:    value,
+			Path:     s.Root(),
+			Secure:   r.TLS != nil,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	mac := hmac.New(sha256.New, s.csrfKey)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkCSRF checks whether a request carries the expected CSRF token.
+// Requests using safe methods do not require a token.
+func checkCSRF(r *http.Request, token string) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	got := r.Header.Get(csrfHeader)
+	if got == "" {
+		got = r.PostFormValue(csrfField)
+	}
+	return token != "" && hmac.Equal([]byte(got), []byte(token))
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
@@ -0,0 +1,113 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRF(t *testing.T) {
+	s := &Server{root: "/", csrfKey: []byte("secret")}
+
+	w := httptest.NewRecorder()
+	token := s.csrfToken(w, httptest.NewRequest("GET", "/", nil))
+	cookies := w.Result().Cookies()
+	if token == "" || len(cookies) != 1 || cookies[0].Name != csrfCookie {
+		t.Fatalf("csrfToken() = %q, cookies %v; want token and %s cookie", token, cookies, csrfCookie)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	if got := s.csrfToken(w, r); got != token {
+		t.Errorf("csrfToken(<cookie>) = %q; want %q", got, token)
+	}
+	if c := w.Result().Cookies(); len(c) != 0 {
+		t.Errorf("csrfToken(<cookie>) issued new cookies %v", c)
+	}
+
+	for _, test := range []struct {
+		method string
+		form   string
+		header string
+		want   bool
+	}{
+		{"GET", "", "", true},
+		{"HEAD", "", "", true},
+		{"POST", "", "", false},
+		{"POST", token, "", true},
+		{"POST", "", token, true},
+		{"POST", "invalid", "", false},
+		{"POST", token[:10], "", false},
+		{"DELETE", "", token, true},
+		{"DELETE", "", "", false},
+	} {
+		body := url.Values{csrfField: {test.form}}.Encode()
+		r := httptest.NewRequest(test.method, "/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.header != "" {
+			r.Header.Set(csrfHeader, test.header)
+		}
+		if got := checkCSRF(r, token); got != test.want {
+			t.Errorf("checkCSRF(%s, form %q, header %q) = %v; want %v",
+				test.method, test.form, test.header, got, test.want)
+		}
+	}
+}
+
+func TestCSRFInput(t *testing.T) {
+	// The placeholder must not survive escaping of untrusted data.
+	if got := string(html(csrfPlaceholder)); strings.Contains(got, csrfPlaceholder) {
+		t.Errorf("html(%q) = %q; want escaped placeholder", csrfPlaceholder, got)
+	}
+	if got := string(csrfInput()); !strings.Contains(got, csrfPlaceholder) {
+		t.Errorf("csrfInput() = %q; want placeholder", got)
+	}
+}
+
+func TestAllowImages(t *testing.T) {
+	csp := "default-src 'self'; img-src 'self' data:; object-src 'none'"
+	for _, test := range []struct {
+		csp, url, want string
+	}{
+		{csp, "/images/owl.png", csp},
+		{csp, "https://cdn.example.com/logo.png",
+			"default-src 'self'; img-src 'self' data: https://cdn.example.com; object-src 'none'"},
+		{csp, "//cdn.example.com:8080/logo.png",
+			"default-src 'self'; img-src 'self' data: cdn.example.com:8080; object-src 'none'"},
+		{"img-src *", "https://cdn.example.com/logo.png", "img-src *"},
+		{"default-src 'self'", "https://cdn.example.com/logo.png", "default-src 'self'"},
+	} {
+		if got := allowImages(test.csp, test.url); got != test.want {
+			t.Errorf("allowImages(%q, %q) = %q; want %q", test.csp, test.url, got, test.want)
+		}
+	}
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
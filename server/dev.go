@@ -0,0 +1,115 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+// Development mode support.
+
+import (
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// A devMode tracks the template directory in development mode.
+type devMode struct {
+	dir  string
+	fsys fs.FS
+
+	// State of the template directory when last parsing the templates.
+	state string
+
+	// Error encountered when last parsing the templates, if any.
+	err error
+}
+
+// dirState returns a summary of the modification times of all files in the
+// specified directory. The summary changes whenever a file is added, removed,
+// or modified.
+func dirState(dir string) (string, error) {
+	if dir == "" {
+		return "", nil
+	}
+	var state string
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			state += fmt.Sprintf("%s:%d:%d;", path, fi.Size(), fi.ModTime().UnixNano())
+		}
+		return nil
+	})
+	return state, err
+}
+
+// refresh parses all templates again if the template directory changed. It
+// does nothing unless running in development mode.
+func (s *Server) refresh() {
+	dev := s.settings().dev
+	if dev == nil {
+		return
+	}
+
+	state, err := dirState(dev.dir)
+	if err != nil || state == dev.state {
+		return
+	}
+	tmpls, err := s.parseAll(dev.fsys)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cur.dev != dev {
+		// Reloaded concurrently.
+		return
+	}
+	set := *s.cur
+	set.dev = &devMode{dir: dev.dir, fsys: dev.fsys, state: state, err: err}
+	if err == nil {
+		set.templates = tmpls
+	}
+	s.cur = &set
+	if err != nil {
+		log.Printf("Template error: %v", err)
+		return
+	}
+	log.Printf("Reloaded templates from %s.", dev.dir)
+}
+
+// report writes the template error to the client.
+func (d *devMode) report(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head><title>SysDB - Template Error</title></head>"+
+		"<body><h1>Template error</h1><pre>%s</pre>"+
+		"<p>The page will be available again once the error has been fixed.</p>"+
+		"</body></html>\n", template.HTMLEscapeString(d.err.Error()))
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
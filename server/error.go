@@ -28,11 +28,11 @@ package server
 // Error handlers for the SysDB web interface.
 
 import (
-	"bytes"
 	"fmt"
-	"io"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
 )
 
 func (s *Server) notfound(w http.ResponseWriter, r *http.Request) {
@@ -47,24 +47,24 @@ func (s *Server) internal(w http.ResponseWriter, err error) {
 	s.err(w, http.StatusInternalServerError, err)
 }
 
-func (s *Server) err(w http.ResponseWriter, status int, err error) {
-	log.Printf("%s: %v", http.StatusText(status), err)
-
-	page := page{
-		Title:   "SysDB - Error",
-		Content: "<section class=\"error\">" + html(err.Error()) + "</section>",
+// toomany reports a request exceeding a limit, asking the client to retry
+// later.
+func (s *Server) toomany(w http.ResponseWriter, err *limitError) {
+	retry := int(math.Ceil(err.retry.Seconds()))
+	if retry < 1 {
+		retry = 1
 	}
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	s.err(w, http.StatusTooManyRequests, err)
+}
 
-	var buf bytes.Buffer
-	err = s.main.Execute(&buf, &page)
-	if err != nil {
-		// Nothing more we can do about this.
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+func (s *Server) err(w http.ResponseWriter, status int, err error) {
+	log.Printf("%s: %v (request %s)", http.StatusText(status), err, w.Header().Get(requestIDHeader))
 
-	w.WriteHeader(status)
-	io.Copy(w, &buf)
+	s.render(w, nil, status, &page{
+		Title:   "Error",
+		Content: "<section class=\"error\">" + html(err.Error()) + "</section>",
+	})
 }
 
 // vim: set tw=78 sw=4 sw=4 noexpandtab :
@@ -0,0 +1,267 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+// Helper functions for exporting host inventories.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/sysdb/go/sysdb"
+)
+
+// An exporter writes a list of hosts in a specific format.
+type exporter struct {
+	contentType string
+	write       func(io.Writer, []sysdb.Host, url.Values) error
+}
+
+// Supported export formats. The format is selected by the first path element
+// following "export", the hosts are selected by the "query" form value.
+var exporters = map[string]exporter{
+	// Ansible dynamic inventory; hosts are grouped by the attributes listed
+	// in the "group-by" form value.
+	"ansible": {"application/json", ansibleInventory},
+
+	// Flat list of hosts and their attributes.
+	"json": {"application/json", jsonHosts},
+	"yaml": {"application/x-yaml; charset=utf-8", yamlHosts},
+
+	// /etc/hosts-style list; addresses are taken from the attribute named by
+	// the "address" form value (default: "address").
+	"hosts": {"text/plain; charset=utf-8", etcHosts},
+}
+
+// export serves the inventory of all hosts matching a query.
+func (s *Server) export(w http.ResponseWriter, req request) {
+	e, ok := exporters[req.params.get("format")]
+	if !ok {
+		s.notfound(w, req.r)
+		return
+	}
+
+	req.r.ParseForm()
+	hosts, err := req.id.lookupHosts(req.r.Form.Get("query"))
+	if err != nil {
+		s.badrequest(w, err)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := e.write(&buf, hosts, req.r.Form); err != nil {
+		s.internal(w, fmt.Errorf("Failed to export hosts: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", e.contentType)
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, &buf)
+}
+
+// formList returns the comma-separated list of values of the specified form
+// field.
+func formList(form url.Values, name string) []string {
+	var list []string
+	for _, v := range form[name] {
+		for _, e := range strings.Split(v, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				list = append(list, e)
+			}
+		}
+	}
+	return list
+}
+
+func attributes(h sysdb.Host) map[string]string {
+	attrs := make(map[string]string, len(h.Attributes))
+	for _, a := range h.Attributes {
+		attrs[a.Name] = a.Value
+	}
+	return attrs
+}
+
+// groupName turns s into a valid Ansible group name.
+func groupName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+type ansibleGroup struct {
+	Hosts []string `json:"hosts"`
+}
+
+func ansibleInventory(w io.Writer, hosts []sysdb.Host, form url.Values) error {
+	groupBy := formList(form, "group-by")
+	grouped := make(map[string]bool, len(groupBy))
+	for _, g := range groupBy {
+		grouped[g] = true
+	}
+
+	inv := map[string]interface{}{}
+	all := &ansibleGroup{Hosts: []string{}}
+	groups := make(map[string]*ansibleGroup)
+	hostvars := make(map[string]map[string]string)
+	for _, h := range hosts {
+		all.Hosts = append(all.Hosts, h.Name)
+
+		vars := make(map[string]string)
+		for name, value := range attributes(h) {
+			if !grouped[name] {
+				vars[name] = value
+				continue
+			}
+			g := groupName(name + "_" + value)
+			if groups[g] == nil {
+				groups[g] = &ansibleGroup{}
+			}
+			groups[g].Hosts = append(groups[g].Hosts, h.Name)
+		}
+		hostvars[h.Name] = vars
+	}
+
+	for name, g := range groups {
+		inv[name] = g
+	}
+	inv["all"] = all
+	inv["_meta"] = map[string]interface{}{"hostvars": hostvars}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(inv)
+}
+
+type exportHost struct {
+	Name       string            `json:"name"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+func exportHosts(hosts []sysdb.Host) []exportHost {
+	list := make([]exportHost, 0, len(hosts))
+	for _, h := range hosts {
+		list = append(list, exportHost{Name: h.Name, Attributes: attributes(h)})
+	}
+	return list
+}
+
+func jsonHosts(w io.Writer, hosts []sysdb.Host, _ url.Values) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(exportHosts(hosts))
+}
+
+// yamlString quotes s such that it's a valid YAML scalar. JSON strings are
+// valid YAML double-quoted scalars.
+func yamlString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+func yamlHosts(w io.Writer, hosts []sysdb.Host, _ url.Values) error {
+	if len(hosts) == 0 {
+		_, err := fmt.Fprintln(w, "[]")
+		return err
+	}
+
+	for _, h := range exportHosts(hosts) {
+		if _, err := fmt.Fprintf(w, "- name: %s\n", yamlString(h.Name)); err != nil {
+			return err
+		}
+		if len(h.Attributes) == 0 {
+			if _, err := fmt.Fprintln(w, "  attributes: {}"); err != nil {
+				return err
+			}
+			continue
+		}
+
+		names := make([]string, 0, len(h.Attributes))
+		for name := range h.Attributes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if _, err := fmt.Fprintln(w, "  attributes:"); err != nil {
+			return err
+		}
+		for _, name := range names {
+			_, err := fmt.Fprintf(w, "    %s: %s\n",
+				yamlString(name), yamlString(h.Attributes[name]))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// etcHosts writes a hosts(5) file. Hosts whose name or address would not be
+// read back as a single field are skipped; they are listed in comments using
+// quoted strings such that they cannot inject additional entries.
+func etcHosts(w io.Writer, hosts []sysdb.Host, form url.Values) error {
+	addr := form.Get("address")
+	if addr == "" {
+		addr = "address"
+	}
+
+	for _, h := range hosts {
+		var err error
+		a, ok := attributes(h)[addr]
+		switch {
+		case !hostsField(h.Name):
+			_, err = fmt.Fprintf(w, "# %q: invalid host name\n", h.Name)
+		case !ok || a == "":
+			_, err = fmt.Fprintf(w, "# %s: no %q attribute\n", h.Name, addr)
+		case !hostsField(a):
+			_, err = fmt.Fprintf(w, "# %s: invalid %q attribute %q\n", h.Name, addr, a)
+		default:
+			_, err = fmt.Fprintf(w, "%s\t%s\n", a, h.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hostsField reports whether s may be used as a field of a hosts file, that
+// is, whether it is not empty and contains no whitespace, control characters,
+// or comments.
+func hostsField(s string) bool {
+	return s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return r == '#' || unicode.IsSpace(r) || unicode.IsControl(r)
+	}) < 0
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
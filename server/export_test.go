@@ -0,0 +1,192 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+import (
+	"bytes"
+	"net/url"
+	"testing"
+
+	"github.com/sysdb/go/sysdb"
+)
+
+func TestExporters(t *testing.T) {
+	hosts := []sysdb.Host{
+		{Name: "db1", Attributes: []sysdb.Attribute{
+			{Name: "address", Value: "192.0.2.1"},
+			{Name: "role", Value: "db"},
+		}},
+		{Name: "web1", Attributes: []sysdb.Attribute{
+			{Name: "role", Value: "web-server"},
+			{Name: "os", Value: "Linux \"x\""},
+		}},
+		{Name: "new"},
+	}
+
+	for _, test := range []struct {
+		format string
+		hosts  []sysdb.Host
+		form   url.Values
+		want   string
+	}{
+		{
+			format: "json",
+			hosts:  hosts[:2],
+			want: `[
+	{
+		"name": "db1",
+		"attributes": {
+			"address": "192.0.2.1",
+			"role": "db"
+		}
+	},
+	{
+		"name": "web1",
+		"attributes": {
+			"os": "Linux \"x\"",
+			"role": "web-server"
+		}
+	}
+]
+`,
+		},
+		{format: "json", want: "[]\n"},
+		{
+			format: "yaml",
+			hosts:  hosts,
+			want: `- name: "db1"
+  attributes:
+    "address": "192.0.2.1"
+    "role": "db"
+- name: "web1"
+  attributes:
+    "os": "Linux \"x\""
+    "role": "web-server"
+- name: "new"
+  attributes: {}
+`,
+		},
+		{format: "yaml", want: "[]\n"},
+		{
+			format: "hosts",
+			hosts:  hosts,
+			want:   "192.0.2.1\tdb1\n# web1: no \"address\" attribute\n# new: no \"address\" attribute\n",
+		},
+		{
+			format: "hosts",
+			hosts:  hosts[1:2],
+			form:   url.Values{"address": {"os"}},
+			want:   `# web1: invalid "os" attribute "Linux \"x\""` + "\n",
+		},
+		{
+			format: "hosts",
+			hosts: []sysdb.Host{
+				{Name: "db1\n192.0.2.66 bank", Attributes: []sysdb.Attribute{{Name: "address", Value: "192.0.2.1"}}},
+				{Name: "db2", Attributes: []sysdb.Attribute{{Name: "address", Value: "192.0.2.2\n192.0.2.66\tbank"}}},
+				{Name: "db3", Attributes: []sysdb.Attribute{{Name: "address", Value: "192.0.2.3#"}}},
+				{Name: "db4", Attributes: []sysdb.Attribute{{Name: "address", Value: "2001:db8::4"}}},
+			},
+			want: `# "db1\n192.0.2.66 bank": invalid host name` + "\n" +
+				`# db2: invalid "address" attribute "192.0.2.2\n192.0.2.66\tbank"` + "\n" +
+				`# db3: invalid "address" attribute "192.0.2.3#"` + "\n" +
+				"2001:db8::4\tdb4\n",
+		},
+		{
+			format: "ansible",
+			hosts:  hosts,
+			form:   url.Values{"group-by": {"role, missing"}},
+			want: `{
+	"_meta": {
+		"hostvars": {
+			"db1": {
+				"address": "192.0.2.1"
+			},
+			"new": {},
+			"web1": {
+				"os": "Linux \"x\""
+			}
+		}
+	},
+	"all": {
+		"hosts": [
+			"db1",
+			"web1",
+			"new"
+		]
+	},
+	"role_db": {
+		"hosts": [
+			"db1"
+		]
+	},
+	"role_web_server": {
+		"hosts": [
+			"web1"
+		]
+	}
+}
+`,
+		},
+		{
+			format: "ansible",
+			want: `{
+	"_meta": {
+		"hostvars": {}
+	},
+	"all": {
+		"hosts": []
+	}
+}
+`,
+		},
+	} {
+		var buf bytes.Buffer
+		if err := exporters[test.format].write(&buf, test.hosts, test.form); err != nil {
+			t.Errorf("%s export = %v; want <nil>", test.format, err)
+			continue
+		}
+		if got := buf.String(); got != test.want {
+			t.Errorf("%s export of %d hosts (%v) =\n%s\nwant:\n%s", test.format, len(test.hosts), test.form, got, test.want)
+		}
+	}
+}
+
+func TestGroupName(t *testing.T) {
+	for _, test := range []struct {
+		s, want string
+	}{
+		{"role_db", "role_db"},
+		{"os_Debian GNU/Linux", "os_Debian_GNU_Linux"},
+		{"dc_eu-west.1", "dc_eu_west_1"},
+		{"name_münchen", "name_m_nchen"},
+	} {
+		if got := groupName(test.s); got != test.want {
+			t.Errorf("groupName(%q) = %q; want %q", test.s, got, test.want)
+		}
+	}
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
@@ -0,0 +1,244 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+// Functions available to all templates.
+//
+// In addition to the predefined functions of the text/template package, all
+// templates may use the following functions:
+//
+//	root               root of the pages of the current SysDB instance
+//	                   (e.g. "/" or "/eu/")
+//	history HOST       recorded changes of the named host, newest first
+//	origin HOST        SysDB instance a host originates from in the federated
+//	                   view, empty otherwise
+//	ago TIME           time relative to now (e.g. "3m ago", "in 5s")
+//	datetime TIME      absolute time (e.g. "2014-12-01 13:37:00 +0100")
+//	duration DURATION  human-readable duration (e.g. "1h 30m")
+//	bytes NUMBER       size using binary prefixes (e.g. "1.5 GiB")
+//	si NUMBER          number using SI prefixes (e.g. "2.3k")
+//	truncate N STRING  STRING shortened to at most N characters
+//	linkify STRING     link to STRING if it is a HTTP(S) URL, STRING otherwise
+//	join LIST SEP      elements of a list of strings separated by SEP
+//	pathescape STRING  STRING escaped for use as a URL path segment
+//	csrf               hidden form field carrying the CSRF token; required
+//	                   in all forms not using the GET method
+//
+// TIME may be a sysdb.Time or time.Time, DURATION a sysdb.Duration or
+// time.Duration. NUMBER may be any integer or floating point value or a
+// string representation of a number (e.g. an attribute value). Other values
+// are formatted as is.
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sysdb/go/sysdb"
+)
+
+// funcs returns the template functions of the server.
+func (s *Server) funcs() template.FuncMap {
+	return template.FuncMap{
+		// Overridden for each instance (see instance.funcs).
+		"root":    s.Root,
+		"history": func(string) []change { return nil },
+		"origin":  origin,
+
+		"ago":        func(v interface{}) string { return ago(v, time.Now()) },
+		"datetime":   formatTime,
+		"duration":   formatDuration,
+		"bytes":      formatBytes,
+		"si":         formatSI,
+		"truncate":   func(n int, s string) string { return truncate(s, n) },
+		"linkify":    linkify,
+		"join":       strings.Join,
+		"pathescape": url.PathEscape,
+		"csrf":       csrfInput,
+	}
+}
+
+func toTime(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case sysdb.Time:
+		return time.Time(t), true
+	case time.Time:
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+func toDuration(v interface{}) (time.Duration, bool) {
+	switch d := v.(type) {
+	case sysdb.Duration:
+		return time.Duration(d), true
+	case time.Duration:
+		return d, true
+	}
+	return 0, false
+}
+
+func toNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// ago formats a time relative to now.
+func ago(v interface{}, now time.Time) string {
+	t, ok := toTime(v)
+	if !ok {
+		return fmt.Sprint(v)
+	}
+	if t.IsZero() {
+		return "never"
+	}
+
+	d := now.Sub(t)
+	if d < 0 {
+		return "in " + approx(-d)
+	}
+	if d < time.Second {
+		return "just now"
+	}
+	return approx(d) + " ago"
+}
+
+// approx formats a duration using its most significant unit.
+func approx(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", d/time.Second)
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	}
+	return fmt.Sprintf("%dd", d/(24*time.Hour))
+}
+
+func formatTime(v interface{}) string {
+	t, ok := toTime(v)
+	if !ok {
+		return fmt.Sprint(v)
+	}
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format("2006-01-02 15:04:05 -0700")
+}
+
+// Units used to format durations.
+var durationUnits = []struct {
+	suffix string
+	d      time.Duration
+}{
+	{"d", 24 * time.Hour},
+	{"h", time.Hour},
+	{"m", time.Minute},
+	{"s", time.Second},
+}
+
+// formatDuration formats a duration using its two most significant units.
+func formatDuration(v interface{}) string {
+	d, ok := toDuration(v)
+	if !ok {
+		return fmt.Sprint(v)
+	}
+
+	for i, u := range durationUnits {
+		if d < u.d {
+			continue
+		}
+		s := fmt.Sprintf("%d%s", d/u.d, u.suffix)
+		if i+1 < len(durationUnits) {
+			next := durationUnits[i+1]
+			if n := d % u.d / next.d; n > 0 {
+				s += fmt.Sprintf(" %d%s", n, next.suffix)
+			}
+		}
+		return s
+	}
+	return d.String()
+}
+
+// scale formats a number using the specified prefixes of powers of base.
+func scale(v interface{}, base float64, prefixes []string, unit string) string {
+	n, ok := toNumber(v)
+	if !ok {
+		return fmt.Sprint(v)
+	}
+
+	i := 0
+	for math.Abs(n) >= base && i < len(prefixes)-1 {
+		n /= base
+		i++
+	}
+	if math.Abs(n) < 100 {
+		n = math.Round(n*10) / 10
+	} else {
+		n = math.Round(n)
+	}
+	return strconv.FormatFloat(n, 'f', -1, 64) + prefixes[i] + unit
+}
+
+func formatBytes(v interface{}) string {
+	return scale(v, 1024, []string{" ", " Ki", " Mi", " Gi", " Ti", " Pi", " Ei"}, "B")
+}
+
+func formatSI(v interface{}) string {
+	return scale(v, 1000, []string{"", "k", "M", "G", "T", "P", "E"}, "")
+}
+
+// linkify turns HTTP(S) URLs into links.
+func linkify(s string) template.HTML {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		strings.ContainsAny(s, " \t\n") {
+		return html(s)
+	}
+	e := template.HTMLEscapeString(s)
+	return template.HTML(`<a href="` + e + `" rel="noopener noreferrer">` + e + `</a>`)
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
@@ -0,0 +1,114 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+import (
+	"html/template"
+	"testing"
+	"time"
+
+	"github.com/sysdb/go/sysdb"
+)
+
+func TestAgo(t *testing.T) {
+	now := time.Date(2014, 12, 1, 13, 37, 0, 0, time.UTC)
+	for _, test := range []struct {
+		v    interface{}
+		want string
+	}{
+		{sysdb.Time(now.Add(-3 * time.Minute)), "3m ago"},
+		{now.Add(-90 * time.Second), "1m ago"},
+		{now.Add(-26 * time.Hour), "1d ago"},
+		{now.Add(5 * time.Second), "in 5s"},
+		{now, "just now"},
+		{sysdb.Time{}, "never"},
+		{"foo", "foo"},
+	} {
+		if got := ago(test.v, now); got != test.want {
+			t.Errorf("ago(%v) = %q; want %q", test.v, got, test.want)
+		}
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	for _, test := range []struct {
+		v    interface{}
+		want string
+	}{
+		{sysdb.Duration(90 * time.Minute), "1h 30m"},
+		{5 * time.Minute, "5m"},
+		{26*time.Hour + 5*time.Minute, "1d 2h"},
+		{24*time.Hour + 5*time.Minute, "1d"},
+		{45 * time.Second, "45s"},
+		{500 * time.Millisecond, "500ms"},
+		{time.Duration(0), "0s"},
+	} {
+		if got := formatDuration(test.v); got != test.want {
+			t.Errorf("formatDuration(%v) = %q; want %q", test.v, got, test.want)
+		}
+	}
+}
+
+func TestFormatNumbers(t *testing.T) {
+	for _, test := range []struct {
+		f    func(interface{}) string
+		name string
+		v    interface{}
+		want string
+	}{
+		{formatBytes, "formatBytes", 512, "512 B"},
+		{formatBytes, "formatBytes", "1536", "1.5 KiB"},
+		{formatBytes, "formatBytes", int64(8589934592), "8 GiB"},
+		{formatBytes, "formatBytes", 250 * 1024 * 1024, "250 MiB"},
+		{formatBytes, "formatBytes", "n/a", "n/a"},
+		{formatSI, "formatSI", 12.345, "12.3"},
+		{formatSI, "formatSI", 2345, "2.3k"},
+		{formatSI, "formatSI", -4200000.0, "-4.2M"},
+	} {
+		if got := test.f(test.v); got != test.want {
+			t.Errorf("%s(%v) = %q; want %q", test.name, test.v, got, test.want)
+		}
+	}
+}
+
+func TestLinkify(t *testing.T) {
+	for _, test := range []struct {
+		s    string
+		want template.HTML
+	}{
+		{"https://example.com/a?b=1&c=2", `<a href="https://example.com/a?b=1&amp;c=2" rel="noopener noreferrer">https://example.com/a?b=1&amp;c=2</a>`},
+		{"javascript:alert(1)", "javascript:alert(1)"},
+		{"<b>http://x</b>", "&lt;b&gt;http://x&lt;/b&gt;"},
+		{"http://a b", "http://a b"},
+		{"foo", "foo"},
+	} {
+		if got := linkify(test.s); got != test.want {
+			t.Errorf("linkify(%q) = %q; want %q", test.s, got, test.want)
+		}
+	}
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
@@ -30,9 +30,7 @@ package server
 import (
 	"bytes"
 	"fmt"
-	"io"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/gonum/plot/vg"
@@ -42,52 +40,64 @@ import (
 
 var urldate = "20060102150405"
 
+// graph plots a single metric or all metrics matching a query. Metrics
+// matching a query may be grouped by the attributes listed in the "g" form
+// value.
 func (s *Server) graph(w http.ResponseWriter, req request) {
-	if len(req.args) < 2 || 4 < len(req.args) {
-		s.badrequest(w, fmt.Errorf("Missing host/metric information"))
-		return
-	}
-
 	end := time.Now()
 	start := end.Add(-24 * time.Hour)
 	var err error
-	if len(req.args) > 2 {
-		if start, err = time.Parse(urldate, req.args[2]); err != nil {
+	if v := req.params.get("start"); v != "" {
+		if start, err = time.Parse(urldate, v); err != nil {
 			s.badrequest(w, fmt.Errorf("Invalid start time: %v", err))
 			return
 		}
 	}
-	if len(req.args) > 3 {
-		if end, err = time.Parse(urldate, req.args[3]); err != nil {
-			s.badrequest(w, fmt.Errorf("Invalid start time: %v", err))
+	if v := req.params.get("end"); v != "" {
+		if end, err = time.Parse(urldate, v); err != nil {
+			s.badrequest(w, fmt.Errorf("Invalid end time: %v", err))
 			return
 		}
 	}
 
+	// Data of time ranges in the past does not change anymore. Allow for some
+	// delay in collecting the most recent data.
+	final := end.Before(time.Now().Add(-5 * time.Minute))
+
+	id := req.id
+	if s.cache.isLive(end) {
+		// Cache current data for a short time only.
+		start, end = s.cache.align(start, end)
+		id = id.withTTL(s.cache.cfg.LiveTTL)
+	}
+
 	g := &graph.Graph{
 		Start: start,
 		End:   end,
 	}
-	if req.args[0] == "q" || len(req.args[0]) > 1 && req.args[0][:2] == "q/" {
-		if g.Metrics, err = s.queryMetrics(req.args[1]); err != nil {
+	if q, ok := req.params["query"]; ok {
+		if g.Metrics, err = req.id.queryMetrics(q[0]); err != nil {
 			s.badrequest(w, fmt.Errorf("Failed to query metrics: %v", err))
 			return
 		}
-
-		if req.args[0] != "q" {
-			for _, arg := range strings.Split(req.args[0][2:], "/") {
-				if arg := strings.SplitN(arg, "=", 2); len(arg) == 2 {
-					if arg[0] == "g" {
-						g.GroupBy = strings.Split(arg[1], ",")
-					}
-				}
-			}
+		if max := s.limits.cfg.MaxGraphMetrics; max > 0 && len(g.Metrics) > max {
+			s.badrequest(w, fmt.Errorf("Query matches %d metrics; graphs may include at most %d",
+				len(g.Metrics), max))
+			return
 		}
+		req.r.ParseForm()
+		g.GroupBy = formList(req.r.Form, "g")
 	} else {
-		g.Metrics = []graph.Metric{{Hostname: req.args[0], Identifier: req.args[1]}}
+		host := req.params.get("host")
+		if err := req.id.visible(host); err != nil {
+			s.notfound(w, req.r)
+			return
+		}
+		g.Metrics = []graph.Metric{{Hostname: host, Identifier: req.params.get("metric")}}
 	}
 
-	p, err := g.Plot(s.c)
+	began := time.Now()
+	p, err := g.Plot(id)
 	if err != nil {
 		s.internal(w, err)
 		return
@@ -104,12 +114,17 @@ func (s *Server) graph(w http.ResponseWriter, req request) {
 		s.internal(w, fmt.Errorf("Failed to write plot: %v", err))
 		return
 	}
+	s.metrics.graphDuration.since(began)
 	w.Header().Set("Content-Type", "image/svg+xml")
-	w.WriteHeader(http.StatusOK)
-	io.Copy(w, &buf)
+	if final {
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+	} else {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	}
+	serveBody(w, req.r, buf.Bytes(), time.Time{})
 }
 
-func (s *Server) queryMetrics(q string) ([]graph.Metric, error) {
+func (id *identity) queryMetrics(q string) ([]graph.Metric, error) {
 	raw, err := parseQuery(q)
 	if err != nil {
 		return nil, err
@@ -118,20 +133,7 @@ func (s *Server) queryMetrics(q string) ([]graph.Metric, error) {
 		return nil, fmt.Errorf("Invalid object type %q for graphs", raw.typ)
 	}
 
-	var args string
-	for name, value := range raw.args {
-		if len(args) > 0 {
-			args += " AND"
-		}
-
-		if name == "name" {
-			args += fmt.Sprintf(" name =~ %s", value)
-		} else {
-			args += fmt.Sprintf(" %s = %s", name, value)
-		}
-	}
-
-	res, err := s.c.Query("LOOKUP metrics MATCHING" + args)
+	res, err := id.lookup("metrics", raw)
 	if err != nil {
 		return nil, err
 	}
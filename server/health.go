@@ -0,0 +1,139 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+// Health and readiness checks.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type health struct {
+	Status    string  `json:"status"`
+	Version   string  `json:"version,omitempty"`
+	LatencyMS float64 `json:"latency_ms,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+func writeHealth(w http.ResponseWriter, status int, h *health) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(h)
+}
+
+// healthz reports that the server is alive.
+func (s *Server) healthz(w http.ResponseWriter, req request) {
+	writeHealth(w, http.StatusOK, &health{Status: "ok"})
+}
+
+// readyz reports whether the server is able to serve requests, that is,
+// whether the SysDB instance of the request responds within the configured
+// timeout. The federated instance is ready if all instances respond.
+func (s *Server) readyz(w http.ResponseWriter, req request) {
+	c, err := req.inst.connect("")
+	if err != nil {
+		writeHealth(w, http.StatusServiceUnavailable, &health{
+			Status: "unavailable",
+			Error:  err.Error(),
+		})
+		return
+	}
+	status, h := req.inst.probe.ready(c, s.settings().readyTimeout)
+	writeHealth(w, status, h)
+}
+
+// A probe checks whether SysDB is available. Concurrent checks share a
+// single query such that checks timing out while SysDB hangs do not pile up.
+type probe struct {
+	mu   sync.Mutex
+	call *probeCall
+}
+
+// A probeCall is a pending query of the version of SysDB.
+type probeCall struct {
+	done    chan struct{}
+	version string
+	err     error
+}
+
+// ready reports the status of SysDB, giving up after the specified timeout.
+func (p *probe) ready(c backend, timeout time.Duration) (int, *health) {
+	start := time.Now()
+	version, err := p.ping(c, timeout)
+	if err != nil {
+		return http.StatusServiceUnavailable, &health{
+			Status: "unavailable",
+			Error:  err.Error(),
+		}
+	}
+	return http.StatusOK, &health{
+		Status:    "ok",
+		Version:   version,
+		LatencyMS: ms(time.Since(start)),
+	}
+}
+
+// ping queries the version of SysDB, giving up after the specified timeout.
+// It joins a pending query, if any.
+func (p *probe) ping(c backend, timeout time.Duration) (string, error) {
+	p.mu.Lock()
+	call := p.call
+	if call == nil {
+		call = &probeCall{done: make(chan struct{})}
+		p.call = call
+		go func() {
+			major, minor, patch, extra, err := c.ServerVersion()
+			call.version = fmt.Sprintf("%d.%d.%d%s", major, minor, patch, extra)
+			call.err = err
+
+			p.mu.Lock()
+			p.call = nil
+			p.mu.Unlock()
+			close(call.done)
+		}()
+	}
+	p.mu.Unlock()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-call.done:
+		if call.err != nil {
+			return "", fmt.Errorf("SysDB unavailable: %v", call.err)
+		}
+		return call.version, nil
+	case <-t.C:
+		return "", errors.New("SysDB did not respond within " + timeout.String())
+	}
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
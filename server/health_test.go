@@ -0,0 +1,97 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A versionBackend reports a fixed version after a delay.
+type versionBackend struct {
+	delay time.Duration
+	err   error
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (b *versionBackend) Query(q string) (interface{}, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (b *versionBackend) ServerVersion() (major, minor, patch int, extra string, err error) {
+	b.mu.Lock()
+	b.calls++
+	b.mu.Unlock()
+	time.Sleep(b.delay)
+	return 0, 5, 1, "-rc1", b.err
+}
+
+func TestReady(t *testing.T) {
+	for _, test := range []struct {
+		b       *versionBackend
+		status  int
+		version string
+		err     string
+	}{
+		{&versionBackend{}, http.StatusOK, "0.5.1-rc1", ""},
+		{&versionBackend{err: errors.New("broken pipe")}, http.StatusServiceUnavailable, "",
+			"SysDB unavailable: broken pipe"},
+		{&versionBackend{delay: time.Second}, http.StatusServiceUnavailable, "",
+			"SysDB did not respond within 10ms"},
+	} {
+		var p probe
+		status, h := p.ready(test.b, 10*time.Millisecond)
+		if status != test.status || h.Version != test.version || h.Error != test.err {
+			t.Errorf("ready(%+v) = %d, %+v; want %d, version %q, error %q",
+				test.b, status, h, test.status, test.version, test.err)
+		}
+	}
+}
+
+func TestProbeCoalesce(t *testing.T) {
+	b := &versionBackend{delay: 100 * time.Millisecond}
+	var p probe
+	for i := 0; i < 5; i++ {
+		if _, err := p.ping(b, time.Millisecond); err == nil {
+			t.Errorf("ping() = <nil>; want timeout")
+		}
+	}
+	if v, err := p.ping(b, time.Second); err != nil || v != "0.5.1-rc1" {
+		t.Errorf("ping() = %q, %v; want \"0.5.1-rc1\", <nil>", v, err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.calls != 1 {
+		t.Errorf("ping() queried SysDB %d times; want 1", b.calls)
+	}
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
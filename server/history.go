@@ -0,0 +1,462 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+// Helper functions for tracking the history of the inventory.
+//
+// SysDB only provides the current state of all objects. The history is
+// tracked by periodically capturing snapshots of all hosts and recording the
+// differences between consecutive snapshots. The latest snapshot and the log
+// of all changes are stored on disk such that the history survives restarts.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sysdb/go/sysdb"
+)
+
+const (
+	snapshotFile = "snapshot.json"
+	changesFile  = "changes.json"
+)
+
+// A change describes a single modification of a host between two snapshots.
+type change struct {
+	Time time.Time
+
+	Host string
+	// Kind is one of "host", "attribute", "service", or "metric".
+	Kind string
+	Name string `json:",omitempty"`
+	// Action is one of "added", "removed", or "changed".
+	Action string
+
+	// Old and new values of changed attributes.
+	Old string `json:",omitempty"`
+	New string `json:",omitempty"`
+}
+
+// A hostState is the part of a host tracked in snapshots.
+type hostState struct {
+	Attributes map[string]string
+	Services   []string
+	Metrics    []string
+}
+
+// Default number of changes kept in the history.
+const defaultHistorySize = 10000
+
+// A history manages the on-disk store of snapshots and changes.
+type history struct {
+	dir string
+	// Maximum number of changes kept.
+	size int
+
+	mu      sync.RWMutex
+	state   map[string]hostState
+	changes []change
+	// Number of changes stored on disk.
+	stored int
+	// Changes which failed to be written to disk.
+	pending []change
+}
+
+// openHistory loads the history stored in the specified directory, keeping
+// up to size changes. The directory will be created if it does not exist
+// yet.
+func openHistory(dir string, size int) (*history, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if size <= 0 {
+		size = defaultHistorySize
+	}
+	h := &history{dir: dir, size: size}
+
+	f, err := os.Open(filepath.Join(dir, snapshotFile))
+	if err == nil {
+		err = json.NewDecoder(f).Decode(&h.state)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid snapshot: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	f, err = os.Open(filepath.Join(dir, changesFile))
+	if err == nil {
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			var c change
+			if err := json.Unmarshal(s.Bytes(), &c); err != nil {
+				return nil, fmt.Errorf("Invalid change log entry: %v", err)
+			}
+			h.changes = append(h.changes, c)
+		}
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	h.stored = len(h.changes)
+	h.trim()
+	return h, nil
+}
+
+// record adds a new snapshot to the history. The first snapshot serves as a
+// baseline and does not generate any changes. The snapshot is stored before
+// the changes such that a failure does not cause changes to be recorded
+// twice; changes which could not be stored are retried with the next
+// snapshot.
+func (h *history) record(t time.Time, state map[string]hostState) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var changes []change
+	if h.state != nil {
+		changes = diffStates(t, h.state, state)
+	}
+
+	if err := writeAtomic(filepath.Join(h.dir, snapshotFile), func(enc *json.Encoder) error {
+		return enc.Encode(state)
+	}); err != nil {
+		return err
+	}
+	h.state = state
+	h.changes = append(h.changes, changes...)
+	h.trim()
+
+	h.pending = append(h.pending, changes...)
+	if len(h.pending) > h.size {
+		h.pending = h.pending[len(h.pending)-h.size:]
+	}
+	if h.stored+len(h.pending) > 2*h.size {
+		// Rotate the change log, keeping the most recent changes only.
+		err := writeAtomic(filepath.Join(h.dir, changesFile), func(enc *json.Encoder) error {
+			for _, c := range h.changes {
+				if err := enc.Encode(&c); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		h.stored, h.pending = len(h.changes), nil
+		return nil
+	}
+	if len(h.pending) == 0 {
+		return nil
+	}
+
+	f, err := os.OpenFile(filepath.Join(h.dir, changesFile),
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, c := range h.pending {
+		if err = enc.Encode(&c); err != nil {
+			break
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	h.stored += len(h.pending)
+	h.pending = nil
+	return nil
+}
+
+// trim drops the oldest changes exceeding the size of the history.
+func (h *history) trim() {
+	if n := len(h.changes) - h.size; n > 0 {
+		h.changes = append([]change(nil), h.changes[n:]...)
+	}
+}
+
+// host returns the state of a host recorded in the latest snapshot.
+func (h *history) host(name string) (hostState, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	hs, ok := h.state[name]
+	return hs, ok
+}
+
+// writeAtomic replaces a file with the JSON data written by f.
+func writeAtomic(path string, f func(*json.Encoder) error) error {
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = f(json.NewEncoder(out))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// recent returns up to limit of the most recent changes (newest first) of
+// all hosts for which the filter returns true. A nil filter matches all
+// hosts, a limit <= 0 returns all changes.
+func (h *history) recent(filter func(host string) bool, limit int) []change {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var changes []change
+	for i := len(h.changes) - 1; i >= 0; i-- {
+		if limit > 0 && len(changes) >= limit {
+			break
+		}
+		if filter == nil || filter(h.changes[i].Host) {
+			changes = append(changes, h.changes[i])
+		}
+	}
+	return changes
+}
+
+// diffStates determines all changes between two snapshots.
+func diffStates(t time.Time, old, new map[string]hostState) []change {
+	var changes []change
+	for _, name := range stateNames(old, new) {
+		o, inOld := old[name]
+		n, inNew := new[name]
+		if !inOld {
+			changes = append(changes, change{Time: t, Host: name, Kind: "host", Action: "added"})
+		} else if !inNew {
+			changes = append(changes, change{Time: t, Host: name, Kind: "host", Action: "removed"})
+			continue
+		}
+
+		for _, attr := range keys(o.Attributes, n.Attributes) {
+			ov, inOld := o.Attributes[attr]
+			nv, inNew := n.Attributes[attr]
+			c := change{Time: t, Host: name, Kind: "attribute", Name: attr, Old: ov, New: nv}
+			switch {
+			case !inOld:
+				c.Action = "added"
+			case !inNew:
+				c.Action = "removed"
+			case ov != nv:
+				c.Action = "changed"
+			default:
+				continue
+			}
+			changes = append(changes, c)
+		}
+		changes = append(changes, diffNames(t, name, "service", o.Services, n.Services)...)
+		changes = append(changes, diffNames(t, name, "metric", o.Metrics, n.Metrics)...)
+	}
+	return changes
+}
+
+func diffNames(t time.Time, host, kind string, old, new []string) []change {
+	o, n := set(old), set(new)
+	var changes []change
+	for _, name := range keys(o, n) {
+		if _, ok := o[name]; !ok {
+			changes = append(changes, change{Time: t, Host: host, Kind: kind, Name: name, Action: "added"})
+		} else if _, ok := n[name]; !ok {
+			changes = append(changes, change{Time: t, Host: host, Kind: kind, Name: name, Action: "removed"})
+		}
+	}
+	return changes
+}
+
+func set(list []string) map[string]string {
+	s := make(map[string]string, len(list))
+	for _, e := range list {
+		s[e] = ""
+	}
+	return s
+}
+
+// keys returns the sorted union of the keys of all maps.
+func keys(maps ...map[string]string) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, m := range maps {
+		for k := range m {
+			if !seen[k] {
+				seen[k] = true
+				names = append(names, k)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func stateNames(maps ...map[string]hostState) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, m := range maps {
+		for k := range m {
+			if !seen[k] {
+				seen[k] = true
+				names = append(names, k)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// snapshots periodically records snapshots of the inventory until the done
+// channel is closed.
+func (s *Server) snapshots(inst *instance, interval time.Duration, done <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if err := s.snapshot(inst); err != nil {
+			log.Printf("Failed to record snapshot%s: %v", inst.label(), err)
+		}
+		select {
+		case <-t.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// snapshot records the current state of all hosts of an instance.
+func (s *Server) snapshot(inst *instance) error {
+	// Snapshots cover all hosts, access is restricted when viewing them.
+	id := &identity{c: inst.c, metrics: s.metrics}
+	res, err := id.list("hosts")
+	if err != nil {
+		return err
+	}
+	hosts, ok := res.([]sysdb.Host)
+	if !ok {
+		return fmt.Errorf("LIST did not return a list of hosts but %T", res)
+	}
+
+	state := make(map[string]hostState, len(hosts))
+	for _, h := range hosts {
+		host, err := id.fetchHost(h.Name)
+		if err != nil {
+			// Keep the previous state rather than reporting the host as
+			// removed.
+			log.Printf("Failed to fetch host %s for snapshot%s: %v", h.Name, inst.label(), err)
+			if hs, ok := inst.history.host(h.Name); ok {
+				state[h.Name] = hs
+			}
+			continue
+		}
+		hs := hostState{Attributes: attributes(*host)}
+		for _, svc := range host.Services {
+			hs.Services = append(hs.Services, svc.Name)
+		}
+		for _, m := range host.Metrics {
+			hs.Metrics = append(hs.Metrics, m.Name)
+		}
+		state[host.Name] = hs
+	}
+	return inst.history.record(time.Now(), state)
+}
+
+// hostHistory returns all recorded changes of the specified host, newest
+// first. It's available to templates as the "history" function.
+func (inst *instance) hostHistory(name string) []change {
+	if inst.history == nil {
+		return nil
+	}
+	return inst.history.recent(func(host string) bool { return host == name }, 0)
+}
+
+func changes(req request, s *Server) (*page, error) {
+	h := req.inst.history
+	if h == nil {
+		if req.inst.members != nil {
+			return nil, errors.New("The inventory history is not available in the federated view")
+		}
+		return nil, errors.New("Inventory history is not enabled")
+	}
+
+	p := struct {
+		Query   string
+		Changes []change
+	}{
+		Query: req.r.FormValue("query"),
+	}
+	limit := 100
+	var err error
+	if l := req.r.FormValue("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil {
+			return nil, fmt.Errorf("Invalid limit %q", l)
+		}
+	}
+
+	var filter func(string) bool
+	if p.Query != "" || len(req.id.filters) > 0 {
+		var hosts []sysdb.Host
+		if p.Query != "" {
+			hosts, err = req.id.lookupHosts(p.Query)
+		} else {
+			var res interface{}
+			if res, err = req.id.list("hosts"); err == nil {
+				hosts, _ = res.([]sysdb.Host)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		names := make(map[string]bool, len(hosts))
+		for _, h := range hosts {
+			names[h.Name] = true
+		}
+		filter = func(host string) bool { return names[host] }
+	}
+	p.Changes = h.recent(filter, limit)
+	return tmpl(s.result(req.inst, "changes"), &p)
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
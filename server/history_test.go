@@ -0,0 +1,171 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	dir := t.TempDir()
+	t1 := time.Date(2014, 4, 1, 12, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+
+	h, err := openHistory(dir, 0)
+	if err != nil {
+		t.Fatalf("openHistory(%q) = %v", dir, err)
+	}
+	if err := h.record(t1, map[string]hostState{
+		"a": {
+			Attributes: map[string]string{"kernel": "3.14", "arch": "amd64"},
+			Services:   []string{"ssh"},
+		},
+		"b": {},
+	}); err != nil {
+		t.Fatalf("record(baseline) = %v", err)
+	}
+	if err := h.record(t2, map[string]hostState{
+		"a": {
+			Attributes: map[string]string{"kernel": "3.16", "rack": "r1"},
+			Services:   []string{"http"},
+			Metrics:    []string{"load"},
+		},
+		"c": {},
+	}); err != nil {
+		t.Fatalf("record() = %v", err)
+	}
+
+	want := []change{
+		{Time: t2, Host: "a", Kind: "attribute", Name: "arch", Action: "removed", Old: "amd64"},
+		{Time: t2, Host: "a", Kind: "attribute", Name: "kernel", Action: "changed", Old: "3.14", New: "3.16"},
+		{Time: t2, Host: "a", Kind: "attribute", Name: "rack", Action: "added", New: "r1"},
+		{Time: t2, Host: "a", Kind: "service", Name: "http", Action: "added"},
+		{Time: t2, Host: "a", Kind: "service", Name: "ssh", Action: "removed"},
+		{Time: t2, Host: "a", Kind: "metric", Name: "load", Action: "added"},
+		{Time: t2, Host: "b", Kind: "host", Action: "removed"},
+		{Time: t2, Host: "c", Kind: "host", Action: "added"},
+	}
+	if !reflect.DeepEqual(h.changes, want) {
+		t.Errorf("record() recorded changes %v; want %v", h.changes, want)
+	}
+
+	// Reload the history from disk.
+	h, err = openHistory(dir, 0)
+	if err != nil {
+		t.Fatalf("openHistory(%q) = %v", dir, err)
+	}
+	if got := h.recent(nil, 0); len(got) != len(want) || !got[0].Time.Equal(t2) {
+		t.Errorf("openHistory(%q) loaded changes %v; want %v", dir, got, want)
+	}
+	got := h.recent(func(host string) bool { return host == "a" }, 2)
+	if len(got) != 2 || got[0].Name != "load" || got[1].Name != "ssh" {
+		t.Errorf("recent(a, 2) = %v; want newest two changes of host a", got)
+	}
+	if len(h.state) != 2 || h.state["a"].Attributes["kernel"] != "3.16" {
+		t.Errorf("openHistory(%q) loaded state %v; want latest snapshot", dir, h.state)
+	}
+}
+
+func TestHistoryRetention(t *testing.T) {
+	dir := t.TempDir()
+	t0 := time.Date(2014, 4, 1, 12, 0, 0, 0, time.UTC)
+	h, err := openHistory(dir, 2)
+	if err != nil {
+		t.Fatalf("openHistory(%q) = %v", dir, err)
+	}
+
+	for i, state := range []map[string]hostState{
+		{},
+		{"a": {}, "b": {}, "c": {}},
+		{},
+		{"d": {}},
+	} {
+		if err := h.record(t0.Add(time.Duration(i)*time.Hour), state); err != nil {
+			t.Fatalf("record(%d) = %v", i, err)
+		}
+		if len(h.changes) > 2 {
+			t.Errorf("record(%d) kept %d changes; want at most 2", i, len(h.changes))
+		}
+	}
+
+	h, err = openHistory(dir, 2)
+	if err != nil {
+		t.Fatalf("openHistory(%q) = %v", dir, err)
+	}
+	want := []change{
+		{Time: t0.Add(2 * time.Hour), Host: "c", Kind: "host", Action: "removed"},
+		{Time: t0.Add(3 * time.Hour), Host: "d", Kind: "host", Action: "added"},
+	}
+	if !reflect.DeepEqual(h.changes, want) {
+		t.Errorf("openHistory(%q) loaded changes %v; want %v", dir, h.changes, want)
+	}
+	if h.stored != 2 {
+		t.Errorf("openHistory(%q) found %d stored changes; want 2 after rotation", dir, h.stored)
+	}
+}
+
+func TestHistoryRetry(t *testing.T) {
+	dir := t.TempDir()
+	t1 := time.Date(2014, 4, 1, 12, 0, 0, 0, time.UTC)
+	h, err := openHistory(dir, 0)
+	if err != nil {
+		t.Fatalf("openHistory(%q) = %v", dir, err)
+	}
+	if err := h.record(t1, map[string]hostState{}); err != nil {
+		t.Fatalf("record(baseline) = %v", err)
+	}
+
+	// Appending to the change log fails while it's a directory.
+	log := filepath.Join(dir, changesFile)
+	if err := os.Mkdir(log, 0755); err != nil {
+		t.Fatal(err)
+	}
+	state := map[string]hostState{"a": {}}
+	if err := h.record(t1.Add(time.Hour), state); err == nil {
+		t.Errorf("record() = <nil>; want error")
+	}
+	if err := os.Remove(log); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.record(t1.Add(2*time.Hour), state); err != nil {
+		t.Fatalf("record() = %v", err)
+	}
+
+	h, err = openHistory(dir, 0)
+	if err != nil {
+		t.Fatalf("openHistory(%q) = %v", dir, err)
+	}
+	want := []change{{Time: t1.Add(time.Hour), Host: "a", Kind: "host", Action: "added"}}
+	if !reflect.DeepEqual(h.changes, want) {
+		t.Errorf("openHistory(%q) loaded changes %v; want %v", dir, h.changes, want)
+	}
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
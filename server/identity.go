@@ -0,0 +1,417 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+// SysDB identities of web users and query-scoped authorization.
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sysdb/go/client"
+	"github.com/sysdb/go/sysdb"
+)
+
+// An Identity specifies how a web user accesses SysDB.
+type Identity struct {
+	// User specifies the SysDB user to connect as. The server's own
+	// connection is used if empty.
+	User string `json:"user"`
+
+	// Filters restricts the hosts visible to the user to those matching any
+	// of the filters. The filters use the syntax of the search box (e.g.
+	// "team:ops"). All hosts are visible if empty.
+	Filters []string `json:"filters"`
+}
+
+// LoadIdentities reads a JSON file mapping web users to their identities.
+func LoadIdentities(path string) (map[string]Identity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ids map[string]Identity
+	if err := json.NewDecoder(f).Decode(&ids); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return ids, nil
+}
+
+// An identity is the resolved Identity of a web user. All queries issued on
+// behalf of a user go through their identity.
+type identity struct {
+	c       backend
+	inst    string
+	user    string
+	filters []*query
+
+	// Query cache (optional) and TTL overriding the configured TTLs.
+	cache *cache
+	ttl   time.Duration
+
+	// Access log entry of the current request (optional).
+	log *accessEntry
+	// Metrics of the server (optional).
+	metrics *metrics
+
+	// Problems which did not prevent serving the current request
+	// (optional).
+	warnings *warnings
+}
+
+// warnings collects messages shown along with a page.
+type warnings struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (w *warnings) add(msg string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, m := range w.msgs {
+		if m == msg {
+			return
+		}
+	}
+	w.msgs = append(w.msgs, msg)
+}
+
+func (w *warnings) list() []string {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.msgs...)
+}
+
+// A pool manages per-user SysDB connections.
+type pool struct {
+	addr string
+	// connect establishes a connection (default: client.Connect).
+	connect func(addr, user string) (*client.Client, error)
+
+	mu      sync.Mutex
+	clients map[string]*client.Client
+	dialing map[string]*dial
+}
+
+// A dial is a pending connection attempt.
+type dial struct {
+	done chan struct{}
+	c    *client.Client
+	err  error
+}
+
+// get returns the connection of the specified SysDB user, establishing a new
+// connection if necessary. Concurrent callers share a single connection
+// attempt per user without blocking callers of other users.
+func (p *pool) get(user string) (*client.Client, error) {
+	p.mu.Lock()
+	if c, ok := p.clients[user]; ok {
+		p.mu.Unlock()
+		return c, nil
+	}
+	d, ok := p.dialing[user]
+	if ok {
+		p.mu.Unlock()
+		<-d.done
+	} else {
+		d = &dial{done: make(chan struct{})}
+		if p.dialing == nil {
+			p.dialing = make(map[string]*dial)
+		}
+		p.dialing[user] = d
+		p.mu.Unlock()
+
+		connect := p.connect
+		if connect == nil {
+			connect = client.Connect
+		}
+		d.c, d.err = connect(p.addr, user)
+
+		p.mu.Lock()
+		delete(p.dialing, user)
+		if d.err == nil {
+			p.clients[user] = d.c
+		}
+		p.mu.Unlock()
+		close(d.done)
+	}
+
+	if d.err != nil {
+		return nil, fmt.Errorf("Failed to connect to SysDB as %q: %v", user, d.err)
+	}
+	return d.c, nil
+}
+
+// close closes all connections of the pool.
+func (p *pool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for user, c := range p.clients {
+		c.Close()
+		delete(p.clients, user)
+	}
+}
+
+// An access is a parsed Identity.
+type access struct {
+	user    string
+	filters []*query
+}
+
+// parseIdentities validates the configured identities.
+func parseIdentities(ids map[string]Identity) (map[string]access, error) {
+	if ids == nil {
+		return nil, nil
+	}
+	identities := make(map[string]access, len(ids))
+	for name, id := range ids {
+		a := access{user: id.User}
+		for _, f := range id.Filters {
+			q, err := parseQuery(f)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid filter %q for user %q: %v", f, name, err)
+			}
+			if q.typ != "" && q.typ != "hosts" {
+				return nil, fmt.Errorf("Invalid filter %q for user %q: filters apply to hosts only", f, name)
+			}
+			if len(q.args) == 0 {
+				return nil, fmt.Errorf("Invalid filter %q for user %q: empty filter", f, name)
+			}
+			a.filters = append(a.filters, q)
+		}
+		identities[name] = a
+	}
+	return identities, nil
+}
+
+// access returns the access rights of a web user. Users without a configured
+// identity use the identity of user "*", if any. All users have unrestricted
+// access if no identities have been configured.
+func (set *settings) access(user string) (access, error) {
+	if set.identities == nil {
+		return access{}, nil
+	}
+	if a, ok := set.identities[user]; ok {
+		return a, nil
+	}
+	if a, ok := set.identities["*"]; ok {
+		return a, nil
+	}
+	return access{}, fmt.Errorf("Access denied for user %q", user)
+}
+
+// identity resolves the identity of a web user accessing the specified
+// instance. Users without a configured identity use the identity of user "*",
+// if any. All users have unrestricted access through the server's own
+// connection if no identities have been configured.
+func (s *Server) identity(set *settings, inst *instance, user string) (*identity, error) {
+	a, err := set.access(user)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := inst.connect(a.user)
+	if err != nil {
+		return nil, err
+	}
+	return &identity{
+		c:        c,
+		inst:     inst.name,
+		user:     a.user,
+		filters:  a.filters,
+		cache:    s.cache,
+		metrics:  s.metrics,
+		warnings: &warnings{},
+	}, nil
+}
+
+// Query executes a query on behalf of the identity, using cached results if
+// possible. Queries sent to SysDB are recorded in the access log entry of the
+// current request. Incomplete results of the federated instance are returned
+// without error; the problem is added to the warnings of the request. They
+// are never cached.
+func (id *identity) Query(q string) (interface{}, error) {
+	var res interface{}
+	var err error
+	if id.cache != nil {
+		res, err = id.cache.query(id.inst+"\x00"+id.user, q, id.ttl, id.metrics, id.query)
+	} else {
+		res, err = id.query(q)
+	}
+	if perr, ok := err.(*partialError); ok {
+		id.warnings.add(perr.Error())
+		return res, nil
+	}
+	return res, err
+}
+
+func (id *identity) query(q string) (interface{}, error) {
+	start := time.Now()
+	res, err := id.c.Query(q)
+	d := time.Since(start)
+	id.log.query(q, d, err)
+	id.metrics.query(q, d, err)
+	return res, err
+}
+
+// withTTL returns a copy of the identity caching results for the specified
+// duration.
+func (id *identity) withTTL(ttl time.Duration) *identity {
+	c := *id
+	c.ttl = ttl
+	return &c
+}
+
+// restrict returns a filter expression restricting objects of the specified
+// type to the hosts visible to the identity. It returns an empty string if
+// all hosts are visible.
+func (id *identity) restrict(typ string) string {
+	if len(id.filters) == 0 {
+		return ""
+	}
+	parent := ""
+	if typ != "hosts" {
+		parent = "host"
+	}
+
+	var alts []string
+	for _, f := range id.filters {
+		alts = append(alts, "("+strings.TrimSpace(f.expr(parent))+")")
+	}
+	return "(" + strings.Join(alts, " OR ") + ")"
+}
+
+// list retrieves all visible objects of the specified type.
+func (id *identity) list(typ string) (interface{}, error) {
+	if r := id.restrict(typ); r != "" {
+		return id.Query(fmt.Sprintf("LOOKUP %s MATCHING %s", typ, r))
+	}
+	q, err := client.QueryString("LIST %s", client.Identifier(typ))
+	if err != nil {
+		return nil, err
+	}
+	return id.Query(q)
+}
+
+// lookup retrieves all visible objects of the specified type matching the
+// parsed query.
+func (id *identity) lookup(typ string, q *query) (interface{}, error) {
+	matching := q.filter()
+	if r := id.restrict(typ); r != "" {
+		if strings.TrimSpace(matching) != "" {
+			matching += " AND"
+		}
+		matching += " " + r
+	}
+	// Don't pass the filter as a format string; it may contain '%'.
+	stmt, err := client.QueryString("LOOKUP %s MATCHING", client.Identifier(typ))
+	if err != nil {
+		return nil, err
+	}
+	return id.Query(stmt + matching)
+}
+
+// visible checks whether the specified host is visible to the identity.
+func (id *identity) visible(host string) error {
+	r := id.restrict("hosts")
+	if r == "" {
+		return nil
+	}
+	q, err := client.QueryString("LOOKUP hosts MATCHING name = %s", host)
+	if err != nil {
+		return err
+	}
+	res, err := id.Query(q + " AND " + r)
+	if err != nil {
+		return err
+	}
+	if hosts, ok := res.([]sysdb.Host); !ok || len(hosts) == 0 {
+		return fmt.Errorf("Host %s not found", host)
+	}
+	return nil
+}
+
+// fetchHost retrieves all information about the host with the specified
+// name.
+func (id *identity) fetchHost(name string) (*sysdb.Host, error) {
+	if err := id.visible(name); err != nil {
+		return nil, err
+	}
+	q, err := client.QueryString("FETCH host %s", name)
+	if err != nil {
+		return nil, err
+	}
+	res, err := id.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	host, ok := res.(*sysdb.Host)
+	if !ok {
+		return nil, fmt.Errorf("FETCH did not return a host but %T", res)
+	}
+	return host, nil
+}
+
+// lookupHosts retrieves all hosts matching the specified query.
+func (id *identity) lookupHosts(q string) ([]sysdb.Host, error) {
+	raw, err := parseQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	if raw.typ != "" && raw.typ != "hosts" {
+		return nil, fmt.Errorf("Invalid object type %q, expected hosts", raw.typ)
+	}
+	return id.lookupHostsMatching(raw)
+}
+
+// lookupHostsMatching retrieves all hosts matching the specified parsed
+// query.
+func (id *identity) lookupHostsMatching(q *query) ([]sysdb.Host, error) {
+	res, err := id.lookup("hosts", q)
+	if err != nil {
+		return nil, err
+	}
+	hosts, ok := res.([]sysdb.Host)
+	if !ok {
+		return nil, fmt.Errorf("LOOKUP did not return a list of hosts but %T", res)
+	}
+	return hosts, nil
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
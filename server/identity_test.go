@@ -0,0 +1,173 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sysdb/go/client"
+	"github.com/sysdb/go/sysdb"
+)
+
+func TestRestrict(t *testing.T) {
+	ids, err := parseIdentities(map[string]Identity{
+		"alice": {Filters: []string{"team:ops", "web1"}},
+		"bob":   {User: "bob"},
+	})
+	if err != nil {
+		t.Fatalf("parseIdentities() = %v", err)
+	}
+
+	for _, test := range []struct {
+		user, typ string
+		want      string
+	}{
+		{"alice", "hosts", "((attribute['team'] = 'ops') OR (name =~ 'web1'))"},
+		{"alice", "services", "((host.attribute['team'] = 'ops') OR (host.name =~ 'web1'))"},
+		{"alice", "metrics", "((host.attribute['team'] = 'ops') OR (host.name =~ 'web1'))"},
+		{"bob", "hosts", ""},
+	} {
+		id := &identity{filters: ids[test.user].filters}
+		if got := id.restrict(test.typ); got != test.want {
+			t.Errorf("restrict(%s, %s) = %q; want %q", test.user, test.typ, got, test.want)
+		}
+	}
+
+	for _, filter := range []string{"services:", "hosts:", "\"unterminated"} {
+		if _, err := parseIdentities(map[string]Identity{"eve": {Filters: []string{filter}}}); err == nil {
+			t.Errorf("parseIdentities(%q) = <nil>; want error", filter)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	ids, err := parseIdentities(map[string]Identity{
+		"alice": {Filters: []string{"team:ops"}},
+	})
+	if err != nil {
+		t.Fatalf("parseIdentities() = %v", err)
+	}
+
+	for _, test := range []struct {
+		query   string
+		filters []*query
+		want    string
+	}{
+		{"web1", nil, "LOOKUP hosts MATCHING name =~ 'web1'"},
+		{"web1", ids["alice"].filters, "LOOKUP hosts MATCHING name =~ 'web1' AND ((attribute['team'] = 'ops'))"},
+		{"hosts:", ids["alice"].filters, "LOOKUP hosts MATCHING ((attribute['team'] = 'ops'))"},
+	} {
+		q, err := parseQuery(test.query)
+		if err != nil {
+			t.Fatalf("parseQuery(%q) = %v", test.query, err)
+		}
+		b := &fakeBackend{}
+		id := &identity{c: b, filters: test.filters}
+		id.lookup("hosts", q)
+		if len(b.queries) != 1 || b.queries[0] != test.want {
+			t.Errorf("lookup(%q) sent %q; want %q", test.query, b.queries, test.want)
+		}
+	}
+}
+
+func TestPartialResults(t *testing.T) {
+	us := &fakeBackend{res: map[string]interface{}{
+		"LIST hosts": []sysdb.Host{{Name: "a"}},
+	}}
+	f := &federation{
+		names:   []string{"us"},
+		clients: []backend{us},
+		owners:  &owners{m: make(map[string]owner)},
+		failed:  []error{errors.New("eu: connection refused")},
+	}
+	cache := newCache(CacheConfig{Size: 10, TTL: map[string]time.Duration{"LIST": time.Minute}})
+	id := &identity{c: f, inst: federatedName, cache: cache, warnings: &warnings{}}
+
+	for i := 0; i < 2; i++ {
+		res, err := id.Query("LIST hosts")
+		if err != nil {
+			t.Fatalf("Query(LIST hosts) = %v; want <nil>", err)
+		}
+		if hosts, ok := res.([]sysdb.Host); !ok || len(hosts) != 1 {
+			t.Errorf("Query(LIST hosts) = %v; want [a]", res)
+		}
+	}
+	want := []string{"Incomplete results: eu: connection refused"}
+	if got := id.warnings.list(); len(got) != 1 || got[0] != want[0] {
+		t.Errorf("warnings = %q; want %q", got, want)
+	}
+	if n := len(us.queries); n != 2 {
+		t.Errorf("Query(LIST hosts) sent %d queries to SysDB; want 2 (incomplete results are not cached)", n)
+	}
+}
+
+func TestPoolDial(t *testing.T) {
+	var mu sync.Mutex
+	dials := make(map[string]int)
+	block := make(chan struct{})
+	p := &pool{
+		clients: make(map[string]*client.Client),
+		connect: func(addr, user string) (*client.Client, error) {
+			mu.Lock()
+			dials[user]++
+			mu.Unlock()
+			if user == "alice" {
+				<-block
+			}
+			return &client.Client{}, nil
+		},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.get("alice"); err != nil {
+				t.Errorf("get(alice) = %v; want <nil>", err)
+			}
+		}()
+	}
+
+	// Connecting as another user does not wait for the pending connection.
+	if _, err := p.get("bob"); err != nil {
+		t.Errorf("get(bob) = %v; want <nil>", err)
+	}
+	close(block)
+	wg.Wait()
+
+	if dials["alice"] != 1 || dials["bob"] != 1 {
+		t.Errorf("get() connected %v times; want once per user", dials)
+	}
+	if len(p.clients) != 2 || len(p.dialing) != 0 {
+		t.Errorf("get() left %d connections, %d pending; want 2, 0", len(p.clients), len(p.dialing))
+	}
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
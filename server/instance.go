@@ -0,0 +1,508 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+// Connections to multiple SysDB instances and the federated view merging
+// their results.
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sysdb/go/client"
+	"github.com/sysdb/go/sysdb"
+)
+
+// An Instance specifies a SysDB server. Pages of an instance are served below
+// its name (e.g. "/eu/hosts"); pages without an instance prefix use the
+// first instance.
+type Instance struct {
+	// Name identifies the instance. It may contain letters, digits, '.', '_',
+	// and '-' and must not be the name of a page or "all".
+	Name string
+
+	// Address and User specify how to connect to SysDB.
+	Address string
+	User    string
+}
+
+const (
+	// Name of the federated instance merging the results of all instances.
+	federatedName = "all"
+
+	// Response header identifying the instance used to serve a request.
+	instanceHeader = "X-SysDB-Instance"
+
+	// OriginAttribute is the attribute added to hosts in the federated view.
+	// Its value is the name of the instance the host originates from.
+	OriginAttribute = "sysdb-instance"
+
+	// Time after which the owner of a host is forgotten unless the host has
+	// been seen again.
+	ownerTTL = time.Hour
+)
+
+// A backend executes SysDB queries.
+type backend interface {
+	Query(q string) (interface{}, error)
+	ServerVersion() (major, minor, patch int, extra string, err error)
+}
+
+// An instance is a SysDB server or the federation of all servers.
+type instance struct {
+	name string
+	// Path prefix of all pages of the instance.
+	base string
+
+	// The server's own connection and per-user connections.
+	c    *client.Client
+	pool *pool
+
+	// History of the inventory (optional).
+	history *history
+
+	// Readiness checks.
+	probe probe
+
+	// Members of the federation and the instances owning their hosts; only
+	// set for the federated instance.
+	members []*instance
+	owners  *owners
+}
+
+// validateInstances checks the names of the configured instances.
+func validateInstances(insts []Instance) error {
+	pages := make(map[string]bool)
+	for _, rt := range (&Server{}).routes() {
+		pages[strings.SplitN(rt.pattern, "/", 2)[0]] = true
+	}
+
+	seen := make(map[string]bool, len(insts))
+	for _, inst := range insts {
+		name := inst.Name
+		if name == "" {
+			return fmt.Errorf("Invalid instance %q: missing name", inst.Address)
+		}
+		if strings.Trim(name, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789._-") != "" {
+			return fmt.Errorf("Invalid instance name %q: must contain letters, digits, '.', '_', and '-' only", name)
+		}
+		if pages[name] || name == federatedName || name == "." || name == ".." {
+			return fmt.Errorf("Invalid instance name %q: reserved name", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("Duplicate instance %q", name)
+		}
+		if inst.Address == "" {
+			return fmt.Errorf("Invalid instance %q: missing address", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// newInstances sets up all instances without connecting to SysDB.
+func (s *Server) newInstances(addr, user string, cfg Config) {
+	insts := cfg.Instances
+	if len(insts) == 0 {
+		insts = []Instance{{Address: addr, User: user}}
+	}
+	for _, in := range insts {
+		inst := &instance{
+			name: in.Name,
+			base: s.Root(),
+			pool: &pool{addr: in.Address, clients: make(map[string]*client.Client)},
+		}
+		if in.Name != "" {
+			inst.base += in.Name + "/"
+		}
+		s.instances = append(s.instances, inst)
+	}
+	if cfg.Federated {
+		s.instances = append(s.instances, &instance{
+			name:    federatedName,
+			base:    s.Root() + federatedName + "/",
+			members: append([]*instance(nil), s.instances...),
+			owners:  &owners{m: make(map[string]owner)},
+		})
+	}
+}
+
+// connect establishes the server's own connections to all instances and
+// opens their history.
+func (s *Server) connect(addr, user string, cfg Config) error {
+	insts := cfg.Instances
+	if len(insts) == 0 {
+		insts = []Instance{{Address: addr, User: user}}
+	}
+	for i, in := range insts {
+		c, err := client.Connect(in.Address, in.User)
+		if err != nil {
+			if in.Name == "" {
+				return err
+			}
+			return fmt.Errorf("Failed to connect to SysDB instance %q: %v", in.Name, err)
+		}
+		inst := s.instances[i]
+		inst.c = c
+		if major, minor, patch, extra, err := c.ServerVersion(); err == nil {
+			log.Printf("Connected to SysDB %d.%d.%d%s%s.", major, minor, patch, extra, inst.label())
+		}
+
+		if cfg.SnapshotPath != "" {
+			// Named instances use subdirectories of the snapshot path.
+			if inst.history, err = openHistory(filepath.Join(cfg.SnapshotPath, in.Name), cfg.HistorySize); err != nil {
+				return fmt.Errorf("Failed to open history%s: %v", inst.label(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// label describes the instance in log messages.
+func (inst *instance) label() string {
+	if inst.name == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (instance %s)", inst.name)
+}
+
+// instance returns the instance with the specified name. It returns the
+// default instance if the name is empty.
+func (s *Server) instance(name string) *instance {
+	if len(s.instances) == 0 {
+		return nil
+	}
+	if name == "" {
+		return s.instances[0]
+	}
+	for _, inst := range s.instances {
+		if inst.name == name {
+			return inst
+		}
+	}
+	return nil
+}
+
+// splitInstance splits the instance prefix off a path relative to the root
+// mount point. It returns the default instance and the unmodified path if
+// the path does not start with the name of an instance.
+func (s *Server) splitInstance(path string) (*instance, string) {
+	name, rest := path, ""
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		name, rest = path[:i], path[i+1:]
+	}
+	if name != "" {
+		if inst := s.instance(name); inst != nil {
+			return inst, rest
+		}
+	}
+	return s.instance(""), path
+}
+
+// connect returns a connection to the instance on behalf of the specified
+// SysDB user. The server's own connection is used if the user is empty. The
+// federated instance connects to all available members; it fails only if
+// none of them is available.
+func (inst *instance) connect(user string) (backend, error) {
+	if inst.members != nil {
+		f := &federation{owners: inst.owners}
+		for _, m := range inst.members {
+			c, err := m.connect(user)
+			if err != nil {
+				f.failed = append(f.failed, fmt.Errorf("%s: %v", m.name, err))
+				continue
+			}
+			f.names = append(f.names, m.name)
+			f.clients = append(f.clients, c)
+		}
+		if len(f.clients) == 0 && len(f.failed) > 0 {
+			return nil, f.failed[0]
+		}
+		return f, nil
+	}
+	if user == "" {
+		return inst.c, nil
+	}
+	return inst.pool.get(user)
+}
+
+// funcs returns the template functions specific to the instance.
+func (inst *instance) funcs() template.FuncMap {
+	return template.FuncMap{
+		"root":    func() string { return inst.base },
+		"history": inst.hostHistory,
+	}
+}
+
+// An instanceLink is an entry of the instance selector.
+type instanceLink struct {
+	Name    string
+	URL     string
+	Current bool
+}
+
+// links returns the entries of the instance selector. It returns nil if
+// there is a single instance only.
+func (s *Server) links(current *instance) []instanceLink {
+	if len(s.instances) < 2 {
+		return nil
+	}
+	links := make([]instanceLink, len(s.instances))
+	for i, inst := range s.instances {
+		links[i] = instanceLink{Name: inst.name, URL: inst.base, Current: inst == current}
+	}
+	return links
+}
+
+// owners maps host names to the instances they originate from.
+type owners struct {
+	mu sync.Mutex
+	m  map[string]owner
+}
+
+type owner struct {
+	inst string
+	seen time.Time
+}
+
+func (o *owners) get(host string) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.m[host].inst
+}
+
+func (o *owners) set(host, inst string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.m[host] = owner{inst: inst, seen: time.Now()}
+}
+
+// prune forgets the owners of hosts not seen since the specified time.
+func (o *owners) prune(before time.Time) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for host, own := range o.m {
+		if own.seen.Before(before) {
+			delete(o.m, host)
+		}
+	}
+}
+
+// A partialError reports the instances which failed to contribute to the
+// results of a federated query. It is returned along with the results of
+// the other instances.
+type partialError struct {
+	errs []error
+}
+
+func (e *partialError) Error() string {
+	msgs := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		msgs[i] = err.Error()
+	}
+	return "Incomplete results: " + strings.Join(msgs, "; ")
+}
+
+// A federation executes queries on all instances. LIST and LOOKUP queries
+// are sent to all instances and their results are merged; hosts are tagged
+// with the OriginAttribute. All other queries are sent to the instance
+// owning the host they refer to, if known, and to the other instances in
+// turn until one of them succeeds.
+type federation struct {
+	names   []string
+	clients []backend
+	owners  *owners
+
+	// Instances which could not be connected to.
+	failed []error
+}
+
+// Query implements the backend interface.
+func (f *federation) Query(q string) (interface{}, error) {
+	switch queryKind(q) {
+	case "LIST", "LOOKUP":
+		return f.merge(q)
+	}
+
+	host := firstString(q)
+	var first error
+	for _, i := range f.order(host) {
+		res, err := f.clients[i].Query(q)
+		if err != nil {
+			if first == nil {
+				first = fmt.Errorf("%s: %v", f.names[i], err)
+			}
+			continue
+		}
+		if h, ok := res.(*sysdb.Host); ok {
+			tag(h, f.names[i])
+			f.owners.set(h.Name, f.names[i])
+		}
+		return res, nil
+	}
+	if first == nil && len(f.failed) > 0 {
+		first = f.failed[0]
+	}
+	if first == nil {
+		first = fmt.Errorf("No SysDB instances configured")
+	}
+	return nil, first
+}
+
+// order returns the indexes of the instances in the order they are queried
+// for the specified host.
+func (f *federation) order(host string) []int {
+	owner := f.owners.get(host)
+	order := make([]int, 0, len(f.names))
+	for i, name := range f.names {
+		if host != "" && name == owner {
+			order = append([]int{i}, order...)
+		} else {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+// merge sends a query to all instances concurrently and merges the
+// resulting lists of hosts. If some of the instances fail, the results of
+// the others are returned along with a *partialError.
+func (f *federation) merge(q string) (interface{}, error) {
+	results := make([]interface{}, len(f.clients))
+	errs := make([]error, len(f.clients))
+	var wg sync.WaitGroup
+	for i, c := range f.clients {
+		wg.Add(1)
+		go func(i int, c backend) {
+			defer wg.Done()
+			results[i], errs[i] = c.Query(q)
+		}(i, c)
+	}
+	wg.Wait()
+
+	var hosts []sysdb.Host
+	failed := append([]error(nil), f.failed...)
+	for i, res := range results {
+		if errs[i] != nil {
+			failed = append(failed, fmt.Errorf("%s: %v", f.names[i], errs[i]))
+			continue
+		}
+		if res == nil {
+			continue
+		}
+		list, ok := res.([]sysdb.Host)
+		if !ok {
+			return nil, fmt.Errorf("%s: cannot merge results of type %T", f.names[i], res)
+		}
+		for _, h := range list {
+			tag(&h, f.names[i])
+			f.owners.set(h.Name, f.names[i])
+			hosts = append(hosts, h)
+		}
+	}
+	f.owners.prune(time.Now().Add(-ownerTTL))
+	sort.SliceStable(hosts, func(i, j int) bool { return hosts[i].Name < hosts[j].Name })
+
+	if len(failed) == len(f.clients)+len(f.failed) && len(failed) > 0 {
+		return nil, failed[0]
+	}
+	if len(failed) > 0 {
+		return hosts, &partialError{failed}
+	}
+	return hosts, nil
+}
+
+// ServerVersion implements the backend interface. It checks that all
+// instances are available and returns the version of the first one.
+func (f *federation) ServerVersion() (major, minor, patch int, extra string, err error) {
+	if len(f.failed) > 0 {
+		return 0, 0, 0, "", f.failed[0]
+	}
+	// Check in reverse order such that the first version is returned.
+	for i := len(f.clients) - 1; i >= 0; i-- {
+		major, minor, patch, extra, err = f.clients[i].ServerVersion()
+		if err != nil {
+			return 0, 0, 0, "", fmt.Errorf("%s: %v", f.names[i], err)
+		}
+	}
+	return major, minor, patch, extra, nil
+}
+
+// tag records the instance a host originates from.
+func tag(h *sysdb.Host, inst string) {
+	for _, a := range h.Attributes {
+		if a.Name == OriginAttribute {
+			return
+		}
+	}
+	// Don't modify the attributes shared with the original result.
+	attrs := make([]sysdb.Attribute, len(h.Attributes), len(h.Attributes)+1)
+	copy(attrs, h.Attributes)
+	h.Attributes = append(attrs, sysdb.Attribute{Name: OriginAttribute, Value: inst})
+}
+
+// origin returns the instance a host originates from or an empty string if
+// unknown. It's available to templates as the "origin" function.
+func origin(h sysdb.Host) string {
+	for _, a := range h.Attributes {
+		if a.Name == OriginAttribute {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// firstString returns the first string literal of a query, unquoted. It
+// returns an empty string if there is none.
+func firstString(q string) string {
+	start := strings.IndexByte(q, '\'')
+	if start < 0 {
+		return ""
+	}
+	var b strings.Builder
+	for i := start + 1; i < len(q); i++ {
+		if q[i] != '\'' {
+			b.WriteByte(q[i])
+			continue
+		}
+		if i+1 < len(q) && q[i+1] == '\'' {
+			// Escaped quote.
+			b.WriteByte('\'')
+			i++
+			continue
+		}
+		return b.String()
+	}
+	return ""
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
@@ -0,0 +1,194 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/sysdb/go/sysdb"
+)
+
+func TestValidateInstances(t *testing.T) {
+	for _, test := range []struct {
+		insts []Instance
+		ok    bool
+	}{
+		{nil, true},
+		{[]Instance{{Name: "eu", Address: "a"}, {Name: "us-1", Address: "b"}}, true},
+		{[]Instance{{Name: "", Address: "a"}}, false},
+		{[]Instance{{Name: "eu", Address: ""}}, false},
+		{[]Instance{{Name: "e/u", Address: "a"}}, false},
+		{[]Instance{{Name: "hosts", Address: "a"}}, false},
+		{[]Instance{{Name: "all", Address: "a"}}, false},
+		{[]Instance{{Name: "eu", Address: "a"}, {Name: "eu", Address: "b"}}, false},
+	} {
+		if err := validateInstances(test.insts); (err == nil) != test.ok {
+			t.Errorf("validateInstances(%v) = %v; want ok = %v", test.insts, err, test.ok)
+		}
+	}
+}
+
+func TestSplitInstance(t *testing.T) {
+	s := &Server{root: "/"}
+	s.newInstances("", "", Config{
+		Instances: []Instance{{Name: "eu", Address: "a"}, {Name: "us", Address: "b"}},
+		Federated: true,
+	})
+
+	for _, test := range []struct {
+		path, inst, rest string
+	}{
+		{"", "eu", ""},
+		{"hosts", "eu", "hosts"},
+		{"eu", "eu", ""},
+		{"us/", "us", ""},
+		{"us/host/a", "us", "host/a"},
+		{"all/hosts", "all", "hosts"},
+		{"usa/hosts", "eu", "usa/hosts"},
+	} {
+		inst, rest := s.splitInstance(test.path)
+		if inst.name != test.inst || rest != test.rest {
+			t.Errorf("splitInstance(%q) = %q, %q; want %q, %q",
+				test.path, inst.name, rest, test.inst, test.rest)
+		}
+	}
+}
+
+func TestFirstString(t *testing.T) {
+	for _, test := range []struct {
+		q, want string
+	}{
+		{"LIST hosts", ""},
+		{"FETCH host 'a'", "a"},
+		{"FETCH service 'a'.'b'", "a"},
+		{"TIMESERIES 'it''s'.'m' START 1", "it's"},
+		{"FETCH host 'unterminated", ""},
+	} {
+		if got := firstString(test.q); got != test.want {
+			t.Errorf("firstString(%q) = %q; want %q", test.q, got, test.want)
+		}
+	}
+}
+
+// A fakeBackend returns fixed results.
+type fakeBackend struct {
+	res     map[string]interface{}
+	queries []string
+}
+
+func (b *fakeBackend) Query(q string) (interface{}, error) {
+	b.queries = append(b.queries, q)
+	if res, ok := b.res[q]; ok {
+		return res, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func (b *fakeBackend) ServerVersion() (major, minor, patch int, extra string, err error) {
+	return 0, 1, 0, "", nil
+}
+
+func TestFederation(t *testing.T) {
+	eu := &fakeBackend{res: map[string]interface{}{
+		"LIST hosts":     []sysdb.Host{{Name: "b"}, {Name: "d"}},
+		"FETCH host 'b'": &sysdb.Host{Name: "b"},
+	}}
+	us := &fakeBackend{res: map[string]interface{}{
+		"LIST hosts":     []sysdb.Host{{Name: "a"}, {Name: "c"}},
+		"FETCH host 'c'": &sysdb.Host{Name: "c"},
+	}}
+	f := &federation{
+		names:   []string{"eu", "us"},
+		clients: []backend{eu, us},
+		owners:  &owners{m: make(map[string]owner)},
+	}
+
+	res, err := f.Query("LIST hosts")
+	if err != nil {
+		t.Fatalf("Query(LIST hosts) = %v; want <nil>", err)
+	}
+	var got []string
+	for _, h := range res.([]sysdb.Host) {
+		got = append(got, h.Name+"@"+origin(h))
+	}
+	if want := []string{"a@us", "b@eu", "c@us", "d@eu"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Query(LIST hosts) = %v; want %v", got, want)
+	}
+
+	// Queries are sent to the owner of the host first.
+	res, err = f.Query("FETCH host 'c'")
+	if err != nil {
+		t.Fatalf("Query(FETCH host 'c') = %v; want <nil>", err)
+	}
+	if h := res.(*sysdb.Host); origin(*h) != "us" {
+		t.Errorf("Query(FETCH host 'c') = %v; want host of instance us", h)
+	}
+	if n := len(eu.queries); n != 1 {
+		t.Errorf("FETCH host 'c' sent to instance eu; want us only")
+	}
+
+	if _, err := f.Query("FETCH host 'x'"); err == nil {
+		t.Errorf("Query(FETCH host 'x') = <nil>; want error")
+	}
+}
+
+func TestFederationPartial(t *testing.T) {
+	eu := &fakeBackend{res: map[string]interface{}{
+		"LIST hosts": []sysdb.Host{{Name: "b"}},
+	}}
+	f := &federation{
+		names:   []string{"eu", "us"},
+		clients: []backend{eu, &fakeBackend{}},
+		owners:  &owners{m: map[string]owner{"old": {inst: "us"}}},
+		failed:  []error{errors.New("ap: connection refused")},
+	}
+
+	res, err := f.Query("LIST hosts")
+	want := "Incomplete results: ap: connection refused; us: not found"
+	if err == nil || err.Error() != want {
+		t.Errorf("Query(LIST hosts) = %v; want %s", err, want)
+	}
+	if hosts, ok := res.([]sysdb.Host); !ok || len(hosts) != 1 || hosts[0].Name != "b" {
+		t.Errorf("Query(LIST hosts) = %v; want [b]", res)
+	}
+	if owner := f.owners.get("old"); owner != "" {
+		t.Errorf("owners.get(old) = %q after merge; want pruned", owner)
+	}
+	if owner := f.owners.get("b"); owner != "eu" {
+		t.Errorf("owners.get(b) = %q; want eu", owner)
+	}
+
+	if _, err := f.Query("LOOKUP hosts MATCHING name = 'x'"); err == nil || err.Error() != "ap: connection refused" {
+		t.Errorf("Query(LOOKUP) with all instances failing = %v; want ap: connection refused", err)
+	}
+	if _, _, _, _, err := f.ServerVersion(); err == nil {
+		t.Errorf("ServerVersion() with unavailable instance = <nil>; want error")
+	}
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
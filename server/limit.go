@@ -0,0 +1,229 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+// Rate limits and concurrency caps protecting SysDB from expensive requests.
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LimitConfig specifies limits applied to expensive requests (graphs,
+// lookups, exports, and other pages querying many objects).
+type LimitConfig struct {
+	// Rate specifies the number of expensive requests per second permitted
+	// for each client. Clients are identified by their user name or, if not
+	// authenticated, by their IP address. Requests are not rate limited if
+	// zero.
+	Rate float64
+
+	// Burst specifies the number of expensive requests a client may issue at
+	// once, e.g. when opening a page showing many graphs (default: 1).
+	Burst int
+
+	// Concurrency specifies the maximum number of expensive requests served
+	// at the same time. Further requests wait for up to QueueTimeout.
+	// Concurrency is not limited if zero.
+	Concurrency int
+
+	// QueueTimeout specifies the maximum time a request waits for other
+	// expensive requests to complete (default: 10 seconds).
+	QueueTimeout time.Duration
+
+	// MaxGraphMetrics specifies the maximum number of metrics a single graph
+	// query may expand to. The number of metrics is not limited if zero.
+	MaxGraphMetrics int
+}
+
+// Commands subject to limits.
+var expensive = map[string]bool{
+	"compare":      true,
+	"export":       true,
+	"graph":        true,
+	"graphs":       true,
+	"lookup":       true,
+	"pivot":        true,
+	"pivot.csv":    true,
+	"topology":     true,
+	"topology.dot": true,
+}
+
+// A limitError reports that a request exceeded a limit.
+type limitError struct {
+	msg   string
+	retry time.Duration
+}
+
+func (e *limitError) Error() string { return e.msg }
+
+// A bucket is a token bucket tracking the requests of a single client.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// A limiter enforces a LimitConfig.
+type limiter struct {
+	cfg LimitConfig
+
+	// Available slots for concurrent requests (optional).
+	slots chan struct{}
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	pruned  time.Time
+}
+
+func newLimiter(cfg LimitConfig) *limiter {
+	if cfg.Burst < 1 {
+		cfg.Burst = 1
+	}
+	if cfg.QueueTimeout <= 0 {
+		cfg.QueueTimeout = 10 * time.Second
+	}
+	l := &limiter{cfg: cfg, buckets: make(map[string]*bucket)}
+	if cfg.Concurrency > 0 {
+		l.slots = make(chan struct{}, cfg.Concurrency)
+	}
+	return l
+}
+
+// allow takes a token from the bucket of the specified client. If the
+// bucket is empty, it returns the time until the next token is available.
+func (l *limiter) allow(client string, now time.Time) (bool, time.Duration) {
+	if l.cfg.Rate <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	burst := float64(l.cfg.Burst)
+	l.prune(now)
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.cfg.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.cfg.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// prune removes the buckets of clients which have been idle long enough for
+// their buckets to be full again. The caller has to hold l.mu.
+func (l *limiter) prune(now time.Time) {
+	full := time.Duration(float64(l.cfg.Burst) / l.cfg.Rate * float64(time.Second))
+	if now.Sub(l.pruned) < full {
+		return
+	}
+	for client, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, client)
+		}
+	}
+	l.pruned = now
+}
+
+// acquire checks the rate limit of the client and waits for a free slot. The
+// returned function releases the slot and has to be called once the request
+// has been served.
+func (l *limiter) acquire(ctx context.Context, client string) (func(), error) {
+	// Clients without address are not rate limited individually.
+	if client != "" {
+		if ok, retry := l.allow(client, time.Now()); !ok {
+			return nil, &limitError{
+				msg:   fmt.Sprintf("Too many requests from %s", client),
+				retry: retry,
+			}
+		}
+	}
+	if l.slots == nil {
+		return func() {}, nil
+	}
+
+	t := time.NewTimer(l.cfg.QueueTimeout)
+	defer t.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, nil
+	case <-t.C:
+		return nil, &limitError{
+			msg:   "Too many concurrent requests; please retry later",
+			retry: time.Second,
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// clientName identifies the client of a request for the purpose of rate
+// limiting given its user name and address. It is empty if neither is known.
+func clientName(addr, user string) string {
+	if user != "" {
+		return user
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// clientAddr returns the address of the client of a request. Requests
+// received on Unix domain sockets (including those passed on by systemd)
+// carry no address; the client is identified by the last address listed in
+// the specified header instead, which has been added by the reverse proxy
+// connecting to the socket. The address is empty if it is unknown.
+func clientAddr(r *http.Request, header string) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil && net.ParseIP(host) != nil {
+		return r.RemoteAddr
+	}
+	if header == "" {
+		return ""
+	}
+	values := r.Header.Values(header)
+	if len(values) == 0 {
+		return ""
+	}
+	addrs := strings.Split(values[len(values)-1], ",")
+	addr := strings.TrimSpace(addrs[len(addrs)-1])
+	if net.ParseIP(addr) == nil {
+		return ""
+	}
+	return addr
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
@@ -0,0 +1,120 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimiterRate(t *testing.T) {
+	l := newLimiter(LimitConfig{Rate: 2, Burst: 3})
+	now := time.Date(2014, 12, 1, 13, 37, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		client string
+		after  time.Duration
+		want   bool
+	}{
+		{"alice", 0, true},
+		{"alice", 0, true},
+		{"alice", 0, true},
+		{"alice", 0, false},
+		{"bob", 0, true},
+		{"alice", 500 * time.Millisecond, true},
+		{"alice", 0, false},
+		{"alice", 10 * time.Second, true},
+		{"alice", 0, true},
+		{"alice", 0, true},
+		{"alice", 0, false},
+	} {
+		now = now.Add(test.after)
+		got, retry := l.allow(test.client, now)
+		if got != test.want {
+			t.Errorf("allow(%q) after %v = %v; want %v", test.client, test.after, got, test.want)
+		}
+		if !got && retry <= 0 {
+			t.Errorf("allow(%q) after %v: retry = %v; want > 0", test.client, test.after, retry)
+		}
+	}
+	if _, ok := l.buckets["bob"]; ok {
+		t.Errorf("allow() did not prune idle client %q", "bob")
+	}
+}
+
+func TestLimiterConcurrency(t *testing.T) {
+	l := newLimiter(LimitConfig{Concurrency: 1, QueueTimeout: 10 * time.Millisecond})
+
+	release, err := l.acquire(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("acquire() = %v; want <nil>", err)
+	}
+	if _, err := l.acquire(context.Background(), "bob"); err == nil {
+		t.Errorf("acquire() with all slots in use = <nil>; want error")
+	} else if _, ok := err.(*limitError); !ok {
+		t.Errorf("acquire() with all slots in use = %T; want *limitError", err)
+	}
+
+	release()
+	release, err = l.acquire(context.Background(), "bob")
+	if err != nil {
+		t.Errorf("acquire() after release = %v; want <nil>", err)
+	} else {
+		release()
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	for _, test := range []struct {
+		remote    string
+		forwarded []string
+		header    string
+		want      string
+	}{
+		{"192.0.2.1:1234", nil, "", "192.0.2.1:1234"},
+		{"192.0.2.1:1234", []string{"198.51.100.1"}, "X-Forwarded-For", "192.0.2.1:1234"},
+		{"@", nil, "X-Forwarded-For", ""},
+		{"@", []string{"198.51.100.1"}, "", ""},
+		{"@", []string{"198.51.100.1"}, "X-Forwarded-For", "198.51.100.1"},
+		{"", []string{"203.0.113.9, 198.51.100.1"}, "X-Forwarded-For", "198.51.100.1"},
+		{"@", []string{"203.0.113.9", "198.51.100.1"}, "X-Forwarded-For", "198.51.100.1"},
+		{"@", []string{"unknown"}, "X-Forwarded-For", ""},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remote
+		for _, v := range test.forwarded {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := clientAddr(r, test.header); got != test.want {
+			t.Errorf("clientAddr(%q, %q, %q) = %q; want %q",
+				test.remote, test.forwarded, test.header, got, test.want)
+		}
+	}
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
@@ -0,0 +1,114 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webui.sock")
+
+	l, err := Listen("unix:"+path, 0600)
+	if err != nil {
+		t.Fatalf("Listen(unix:%s) = %v; want <nil>", path, err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Listen(unix:%s) created %v (%v); want socket with mode 0600", path, fi, err)
+	}
+	if _, err := Listen("unix:"+path, 0); err == nil {
+		t.Errorf("Listen(unix:%s) while in use = <nil>; want error", path)
+	}
+	l.Close()
+
+	// Stale socket files are removed.
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen("unix:"+path, 0); err == nil {
+		t.Errorf("Listen(unix:%s) replaced a regular file; want error", path)
+	}
+	os.Remove(path)
+	ul, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ul.SetUnlinkOnClose(false)
+	ul.Close()
+	l, err = Listen("unix:"+path, 0)
+	if err != nil {
+		t.Fatalf("Listen(unix:%s) with stale socket = %v; want <nil>", path, err)
+	}
+	l.Close()
+}
+
+func TestSystemdListeners(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, test := range []struct {
+		env  map[string]string
+		want int
+	}{
+		{map[string]string{}, 0},
+		{map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "1"}, 0},
+		{map[string]string{"LISTEN_PID": strconv.Itoa(os.Getpid()), "LISTEN_FDS": "1"}, 1},
+	} {
+		// systemdListeners takes ownership of the file descriptor.
+		fd, err := syscall.Dup(int(f.Fd()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ls, err := systemdListeners(func(k string) string { return test.env[k] }, fd)
+		if len(ls) == 0 {
+			syscall.Close(fd)
+		}
+		if err != nil || len(ls) != test.want {
+			t.Errorf("systemdListeners(%v) = %d listeners (%v); want %d", test.env, len(ls), err, test.want)
+		}
+		for _, sl := range ls {
+			if got, want := sl.Addr().String(), l.Addr().String(); got != want {
+				t.Errorf("systemdListeners(%v) = %s; want %s", test.env, got, want)
+			}
+			sl.Close()
+		}
+	}
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
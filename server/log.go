@@ -0,0 +1,207 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+// Access logging.
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Header used to return the ID of a request.
+const requestIDHeader = "X-Request-ID"
+
+// Access log formats.
+const (
+	LogText = "text"
+	LogJSON = "json"
+)
+
+// A statusWriter records the status and size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap provides access to the underlying writer for http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// A queryLog describes a SysDB query issued while serving a request.
+type queryLog struct {
+	Query    string
+	Duration time.Duration
+	Err      error
+}
+
+// An accessEntry collects information about a request for the access log.
+type accessEntry struct {
+	id      string
+	start   time.Time
+	user    string
+	remote  string
+	handler string
+
+	mu      sync.Mutex
+	queries []queryLog
+}
+
+// newRequestID generates a random request ID.
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// query records a SysDB query. It may be called on a nil entry.
+func (e *accessEntry) query(q string, d time.Duration, err error) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.queries = append(e.queries, queryLog{Query: q, Duration: d, Err: err})
+}
+
+type jsonQuery struct {
+	Query      string  `json:"query"`
+	DurationMS float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+type jsonEntry struct {
+	Time       string      `json:"time"`
+	ID         string      `json:"id"`
+	Remote     string      `json:"remote"`
+	User       string      `json:"user,omitempty"`
+	Method     string      `json:"method"`
+	Path       string      `json:"path"`
+	Proto      string      `json:"proto"`
+	Status     int         `json:"status"`
+	Bytes      int64       `json:"bytes"`
+	DurationMS float64     `json:"duration_ms"`
+	Queries    []jsonQuery `json:"queries,omitempty"`
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// writeAccess writes an access log entry in the specified format.
+func writeAccess(out io.Writer, format string, r *http.Request, w *statusWriter, e *accessEntry, end time.Time) error {
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if format == LogJSON {
+		entry := jsonEntry{
+			Time:       e.start.Format(time.RFC3339Nano),
+			ID:         e.id,
+			Remote:     e.remote,
+			User:       e.user,
+			Method:     r.Method,
+			Path:       r.RequestURI,
+			Proto:      r.Proto,
+			Status:     status,
+			Bytes:      w.bytes,
+			DurationMS: ms(end.Sub(e.start)),
+		}
+		for _, q := range e.queries {
+			jq := jsonQuery{Query: q.Query, DurationMS: ms(q.Duration)}
+			if q.Err != nil {
+				jq.Error = q.Err.Error()
+			}
+			entry.Queries = append(entry.Queries, jq)
+		}
+		b, err := json.Marshal(&entry)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(append(b, '\n'))
+		return err
+	}
+
+	// Common log format extended by the duration, request ID, and number of
+	// queries followed by each query along with its duration (and error) as
+	// a quoted field.
+	user := e.user
+	if user == "" {
+		user = "-"
+	}
+	remote := e.remote
+	if remote == "" {
+		remote = "-"
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s - %s [%s] %q %d %d %s id=%s queries=%d",
+		remote, user, e.start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method+" "+r.RequestURI+" "+r.Proto, status, w.bytes,
+		end.Sub(e.start).Round(time.Microsecond), e.id, len(e.queries))
+	for _, q := range e.queries {
+		d := q.Duration.Round(time.Microsecond).String()
+		if q.Err != nil {
+			d += ": " + q.Err.Error()
+		}
+		fmt.Fprintf(&buf, " %q", q.Query+" ("+d+")")
+	}
+	buf.WriteByte('\n')
+	_, err := out.Write(buf.Bytes())
+	return err
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
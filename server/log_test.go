@@ -0,0 +1,73 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWriteAccess(t *testing.T) {
+	start := time.Date(2014, 12, 1, 13, 37, 0, 0, time.UTC)
+	e := &accessEntry{id: "0123456789abcdef", start: start, user: "alice", remote: "192.0.2.1:1234"}
+	e.query("FETCH host 'a'", 2*time.Millisecond, nil)
+	e.query("LIST hosts", time.Millisecond, errors.New("failed"))
+
+	r := httptest.NewRequest("GET", "/host/a", nil)
+	w := &statusWriter{ResponseWriter: httptest.NewRecorder()}
+	w.Write([]byte("hello"))
+
+	for _, test := range []struct {
+		format string
+		want   string
+	}{
+		{
+			format: LogText,
+			want: "192.0.2.1:1234 - alice [01/Dec/2014:13:37:00 +0000] \"GET /host/a HTTP/1.1\" 200 5 10ms id=0123456789abcdef queries=2 " +
+				`"FETCH host 'a' (2ms)" "LIST hosts (1ms: failed)"` + "\n",
+		},
+		{
+			format: LogJSON,
+			want: `{"time":"2014-12-01T13:37:00Z","id":"0123456789abcdef","remote":"192.0.2.1:1234","user":"alice",` +
+				`"method":"GET","path":"/host/a","proto":"HTTP/1.1","status":200,"bytes":5,"duration_ms":10,` +
+				`"queries":[{"query":"FETCH host 'a'","duration_ms":2},{"query":"LIST hosts","duration_ms":1,"error":"failed"}]}` + "\n",
+		},
+	} {
+		var buf bytes.Buffer
+		if err := writeAccess(&buf, test.format, r, w, e, start.Add(10*time.Millisecond)); err != nil {
+			t.Errorf("writeAccess(%s) = %v; want <nil>", test.format, err)
+			continue
+		}
+		if got := buf.String(); got != test.want {
+			t.Errorf("writeAccess(%s) wrote:\n%s\nwant:\n%s", test.format, got, test.want)
+		}
+	}
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
@@ -0,0 +1,342 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+// Self-monitoring metrics exposed in the Prometheus text format.
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default histogram buckets (in seconds).
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// A metricVec is a family of counters or histograms partitioned by labels.
+type metricVec struct {
+	name, help string
+	labels     []string
+	// Histograms only.
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labels []string
+
+	// Counter value or sum of all observations.
+	value float64
+	// Histograms only.
+	count  uint64
+	counts []uint64
+}
+
+func newCounter(name, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, labels: labels, series: make(map[string]*series)}
+}
+
+func newHistogram(name, help string, labels ...string) *metricVec {
+	v := newCounter(name, help, labels...)
+	v.buckets = defaultBuckets
+	return v
+}
+
+func (v *metricVec) get(labels []string) *series {
+	key := strings.Join(labels, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labels: labels}
+		if v.buckets != nil {
+			s.counts = make([]uint64, len(v.buckets))
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+// inc increments the counter identified by the specified label values.
+func (v *metricVec) inc(labels ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.get(labels).value++
+}
+
+// observe adds an observation to the histogram identified by the specified
+// label values.
+func (v *metricVec) observe(x float64, labels ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s := v.get(labels)
+	s.value += x
+	s.count++
+	for i, b := range v.buckets {
+		if x <= b {
+			s.counts[i]++
+		}
+	}
+}
+
+// since observes the time elapsed since start in seconds.
+func (v *metricVec) since(start time.Time, labels ...string) {
+	v.observe(time.Since(start).Seconds(), labels...)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelString(names, values []string, extra ...string) string {
+	var pairs []string
+	for i, n := range names {
+		pairs = append(pairs, n+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+labelEscaper.Replace(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// write writes all series in the Prometheus text format.
+func (v *metricVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	typ := "counter"
+	if v.buckets != nil {
+		typ = "histogram"
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, typ)
+
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := v.series[k]
+		if v.buckets == nil {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, labelString(v.labels, s.labels), formatFloat(s.value))
+			continue
+		}
+		for i, b := range v.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name,
+				labelString(v.labels, s.labels, "le", formatFloat(b)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name,
+			labelString(v.labels, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, labelString(v.labels, s.labels), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, labelString(v.labels, s.labels), s.count)
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(value))
+}
+
+// metrics collects all metrics of a server.
+type metrics struct {
+	requests        *metricVec
+	requestDuration *metricVec
+	queries         *metricVec
+	queryErrors     *metricVec
+	queryDuration   *metricVec
+	graphDuration   *metricVec
+	cacheRequests   *metricVec
+
+	mu       sync.Mutex
+	inFlight int
+	sysdbUp  bool
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests: newCounter("sysdb_webui_http_requests_total",
+			"Number of HTTP requests by handler and status code.", "handler", "code"),
+		requestDuration: newHistogram("sysdb_webui_http_request_duration_seconds",
+			"Latency of HTTP requests by handler.", "handler"),
+		queries: newCounter("sysdb_webui_sysdb_queries_total",
+			"Number of SysDB queries by kind.", "kind"),
+		queryErrors: newCounter("sysdb_webui_sysdb_query_errors_total",
+			"Number of failed SysDB queries by kind.", "kind"),
+		queryDuration: newHistogram("sysdb_webui_sysdb_query_duration_seconds",
+			"Latency of SysDB queries by kind.", "kind"),
+		graphDuration: newHistogram("sysdb_webui_graph_render_duration_seconds",
+			"Time spent fetching data for and rendering graphs."),
+		cacheRequests: newCounter("sysdb_webui_cache_requests_total",
+			"Number of cacheable queries by result (hit, miss, coalesced).", "result"),
+	}
+}
+
+// Query kinds reported in metrics.
+var queryKinds = map[string]bool{
+	"FETCH": true, "LIST": true, "LOOKUP": true, "TIMESERIES": true,
+}
+
+// queryKind returns the kind of a SysDB query (e.g. "LOOKUP").
+func queryKind(q string) string {
+	kind := strings.ToUpper(strings.SplitN(strings.TrimSpace(q), " ", 2)[0])
+	if queryKinds[kind] {
+		return kind
+	}
+	return "OTHER"
+}
+
+// query records a SysDB query. It may be called on nil metrics.
+func (m *metrics) query(q string, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	kind := queryKind(q)
+	m.queries.inc(kind)
+	m.queryDuration.observe(d.Seconds(), kind)
+	if err != nil {
+		m.queryErrors.inc(kind)
+	}
+
+	m.mu.Lock()
+	m.sysdbUp = err == nil
+	m.mu.Unlock()
+}
+
+// cache records the result of a cache lookup. It may be called on nil
+// metrics.
+func (m *metrics) cache(result string) {
+	if m != nil {
+		m.cacheRequests.inc(result)
+	}
+}
+
+func (m *metrics) begin() {
+	m.mu.Lock()
+	m.inFlight++
+	m.mu.Unlock()
+}
+
+// end records a completed request.
+func (m *metrics) end(handler string, status int, d time.Duration) {
+	m.mu.Lock()
+	m.inFlight--
+	m.mu.Unlock()
+
+	m.requests.inc(handler, strconv.Itoa(status))
+	m.requestDuration.observe(d.Seconds(), handler)
+}
+
+// handlerName returns the name of the handler of the specified command as
+// used in metrics.
+func (s *Server) handlerName(cmd string) string {
+	if cmd == "" {
+		return "index"
+	}
+	if cmd == metricsHandler || s.router.has(cmd) {
+		return cmd
+	}
+	return "other"
+}
+
+// Name of the metrics handler in the metrics and the access log. It is
+// distinct from the "metrics" page listing all metrics stored in SysDB.
+const metricsHandler = "prometheus"
+
+// Metrics returns a handler serving the server's metrics in the Prometheus
+// text format. Unless Config.MetricsPublic is set, the same users as for the
+// user interface are allowed to access the metrics. Requests are recorded in
+// the access log.
+func (s *Server) Metrics() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.handle(w, r, s.serveMetrics)
+	})
+}
+
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request, set *settings, e *accessEntry) {
+	e.handler = metricsHandler
+	if !set.metricsPublic {
+		user, ok := s.authenticate(w, r, set, e.handler)
+		if !ok {
+			return
+		}
+		e.user = user
+		if _, err := set.access(user); err != nil {
+			s.err(w, http.StatusForbidden, err)
+			return
+		}
+	}
+
+	m := s.metrics
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	m.mu.Lock()
+	inFlight, up := m.inFlight, m.sysdbUp
+	m.mu.Unlock()
+	writeGauge(w, "sysdb_webui_http_requests_in_flight",
+		"Number of HTTP requests currently being served.", float64(inFlight))
+
+	for _, v := range []*metricVec{
+		m.requests, m.requestDuration,
+		m.queries, m.queryErrors, m.queryDuration,
+		m.graphDuration, m.cacheRequests,
+	} {
+		v.write(w)
+	}
+
+	var b float64
+	if up {
+		b = 1
+	}
+	writeGauge(w, "sysdb_webui_sysdb_up",
+		"Whether the most recent SysDB query succeeded.", b)
+	conns := 0
+	for _, inst := range s.instances {
+		if inst.pool != nil {
+			inst.pool.mu.Lock()
+			conns += len(inst.pool.clients) + 1
+			inst.pool.mu.Unlock()
+		}
+	}
+	writeGauge(w, "sysdb_webui_sysdb_connections",
+		"Number of open connections to SysDB.", float64(conns))
+	writeGauge(w, "sysdb_webui_cache_entries",
+		"Number of cached query results.", float64(s.cache.len()))
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
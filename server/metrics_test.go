@@ -0,0 +1,138 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+import (
+	"bytes"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestQueryKind(t *testing.T) {
+	for _, test := range []struct {
+		q    string
+		want string
+	}{
+		{"LIST hosts", "LIST"},
+		{" lookup hosts MATCHING name = 'a'", "LOOKUP"},
+		{"FETCH host 'a'", "FETCH"},
+		{"TIMESERIES 'a'.'b'", "TIMESERIES"},
+		{"STORE host 'a'", "OTHER"},
+		{"", "OTHER"},
+	} {
+		if got := queryKind(test.q); got != test.want {
+			t.Errorf("queryKind(%q) = %q; want %q", test.q, got, test.want)
+		}
+	}
+}
+
+func TestMetricVec(t *testing.T) {
+	c := newCounter("requests_total", "Requests.", "handler", "code")
+	c.inc("host", "200")
+	c.inc("host", "200")
+	c.inc("a\"b", "404")
+
+	h := newHistogram("duration_seconds", "Duration.")
+	h.buckets = []float64{.1, 1}
+	h.observe(.05)
+	h.observe(.5)
+	h.observe(2)
+
+	var buf bytes.Buffer
+	c.write(&buf)
+	h.write(&buf)
+	want := `# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{handler="a\"b",code="404"} 1
+requests_total{handler="host",code="200"} 2
+# HELP duration_seconds Duration.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{le="0.1"} 1
+duration_seconds_bucket{le="1"} 2
+duration_seconds_bucket{le="+Inf"} 3
+duration_seconds_sum 2.55
+duration_seconds_count 3
+`
+	if got := buf.String(); got != want {
+		t.Errorf("write() =\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	_, n, _ := net.ParseCIDR("192.0.2.0/24")
+	var log bytes.Buffer
+	cfg := Config{
+		Templates: os.DirFS("../templates"),
+		Static:    os.DirFS("../static"),
+		Auth:      &ProxyHeader{Header: "X-Remote-User", Trusted: []*net.IPNet{n}},
+		AccessLog: &log,
+	}
+	s := &Server{root: "/", metrics: newMetrics(), cache: newCache(CacheConfig{})}
+	s.newInstances("", "", cfg)
+	if err := s.Reload(cfg); err != nil {
+		t.Fatalf("Reload() = %v; want <nil>", err)
+	}
+
+	for _, test := range []struct {
+		public bool
+		user   string
+		want   int
+	}{
+		{false, "", 401},
+		{false, "alice", 200},
+		{true, "", 200},
+	} {
+		cfg.MetricsPublic = test.public
+		if err := s.Reload(cfg); err != nil {
+			t.Fatalf("Reload() = %v; want <nil>", err)
+		}
+		log.Reset()
+
+		r := httptest.NewRequest("GET", "/-/metrics", nil)
+		if test.user != "" {
+			r.Header.Set("X-Remote-User", test.user)
+		}
+		w := httptest.NewRecorder()
+		s.Metrics().ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("Metrics() (public: %v, user: %q) = %d; want %d",
+				test.public, test.user, w.Code, test.want)
+		}
+		if test.want == 200 && !strings.Contains(w.Body.String(), "sysdb_webui_http_requests_in_flight 1") {
+			t.Errorf("Metrics() (public: %v, user: %q) = %q; want metrics",
+				test.public, test.user, w.Body.String())
+		}
+		if want := "GET /-/metrics HTTP/1.1"; !strings.Contains(log.String(), want) {
+			t.Errorf("Metrics() (public: %v, user: %q) logged %q; want entry for %q",
+				test.public, test.user, log.String(), want)
+		}
+	}
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
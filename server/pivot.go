@@ -0,0 +1,151 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+// Helper functions for attribute pivot tables.
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/sysdb/go/sysdb"
+)
+
+// A pivotTable lists the values of a set of attributes across hosts.
+type pivotTable struct {
+	// The query and (comma-separated) attribute names the table was built
+	// from.
+	Query, Attributes string
+
+	// Column to sort by (empty for the host name) and sort order.
+	Sort string
+	Desc bool
+
+	Columns []string
+	Rows    []pivotRow
+}
+
+type pivotRow struct {
+	Host   string
+	Values []string
+}
+
+func pivot(req request, s *Server) (*page, error) {
+	t, err := buildPivot(req)
+	if err != nil {
+		return nil, err
+	}
+	return tmpl(s.result(req.inst, "pivot"), t)
+}
+
+// pivotCSV serves a pivot table in CSV format.
+func (s *Server) pivotCSV(w http.ResponseWriter, req request) {
+	t, err := buildPivot(req)
+	if err != nil {
+		s.badrequest(w, err)
+		return
+	}
+
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	cw.Write(append([]string{"host"}, t.Columns...))
+	for _, r := range t.Rows {
+		cw.Write(append([]string{r.Host}, r.Values...))
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		s.internal(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"pivot.csv\"")
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, &buf)
+}
+
+// buildPivot builds a pivot table based on the request's form values.
+func buildPivot(req request) (*pivotTable, error) {
+	r := req.r
+	t := &pivotTable{
+		Query:      r.FormValue("query"),
+		Attributes: r.FormValue("attributes"),
+		Sort:       r.FormValue("sort"),
+		Desc:       r.FormValue("order") == "desc",
+	}
+	t.Columns = formList(r.Form, "attributes")
+	if t.Query == "" {
+		return t, nil
+	}
+
+	hosts, err := req.id.lookupHosts(t.Query)
+	if err != nil {
+		return nil, err
+	}
+	t.Rows = pivotRows(hosts, t.Columns)
+	t.sort()
+	return t, nil
+}
+
+func pivotRows(hosts []sysdb.Host, columns []string) []pivotRow {
+	rows := make([]pivotRow, 0, len(hosts))
+	for _, h := range hosts {
+		attrs := attributes(h)
+		r := pivotRow{Host: h.Name, Values: make([]string, len(columns))}
+		for i, c := range columns {
+			r.Values[i] = attrs[c]
+		}
+		rows = append(rows, r)
+	}
+	return rows
+}
+
+// sort sorts the table's rows by the configured column, falling back to the
+// host name for unknown columns and ties.
+func (t *pivotTable) sort() {
+	col := -1
+	for i, c := range t.Columns {
+		if c == t.Sort {
+			col = i
+			break
+		}
+	}
+	sort.SliceStable(t.Rows, func(i, j int) bool {
+		a, b := t.Rows[i], t.Rows[j]
+		if t.Desc {
+			a, b = b, a
+		}
+		if col >= 0 && a.Values[col] != b.Values[col] {
+			return a.Values[col] < b.Values[col]
+		}
+		return a.Host < b.Host
+	})
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
@@ -0,0 +1,122 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sysdb/go/sysdb"
+)
+
+func TestPivot(t *testing.T) {
+	hosts := []sysdb.Host{
+		{
+			Name: "c",
+			Attributes: []sysdb.Attribute{
+				{Name: "os", Value: "linux"},
+				{Name: "rack", Value: "r1"},
+			},
+		},
+		{
+			Name: "a",
+			Attributes: []sysdb.Attribute{
+				{Name: "os", Value: "bsd"},
+			},
+		},
+		{
+			Name: "b",
+			Attributes: []sysdb.Attribute{
+				{Name: "os", Value: "linux"},
+				{Name: "rack", Value: "r2"},
+			},
+		},
+	}
+	columns := []string{"os", "rack"}
+
+	for _, test := range []struct {
+		sort string
+		desc bool
+		want []pivotRow
+	}{
+		{
+			sort: "",
+			want: []pivotRow{
+				{Host: "a", Values: []string{"bsd", ""}},
+				{Host: "b", Values: []string{"linux", "r2"}},
+				{Host: "c", Values: []string{"linux", "r1"}},
+			},
+		},
+		{
+			sort: "",
+			desc: true,
+			want: []pivotRow{
+				{Host: "c", Values: []string{"linux", "r1"}},
+				{Host: "b", Values: []string{"linux", "r2"}},
+				{Host: "a", Values: []string{"bsd", ""}},
+			},
+		},
+		{
+			sort: "rack",
+			want: []pivotRow{
+				{Host: "a", Values: []string{"bsd", ""}},
+				{Host: "c", Values: []string{"linux", "r1"}},
+				{Host: "b", Values: []string{"linux", "r2"}},
+			},
+		},
+		{
+			sort: "os",
+			desc: true,
+			want: []pivotRow{
+				{Host: "c", Values: []string{"linux", "r1"}},
+				{Host: "b", Values: []string{"linux", "r2"}},
+				{Host: "a", Values: []string{"bsd", ""}},
+			},
+		},
+		{
+			sort: "unknown",
+			want: []pivotRow{
+				{Host: "a", Values: []string{"bsd", ""}},
+				{Host: "b", Values: []string{"linux", "r2"}},
+				{Host: "c", Values: []string{"linux", "r1"}},
+			},
+		},
+	} {
+		p := &pivotTable{
+			Sort:    test.sort,
+			Desc:    test.desc,
+			Columns: columns,
+			Rows:    pivotRows(hosts, columns),
+		}
+		p.sort()
+		if !reflect.DeepEqual(p.Rows, test.want) {
+			t.Errorf("pivot(sort=%q, desc=%v) = %v; want %v",
+				test.sort, test.desc, p.Rows, test.want)
+		}
+	}
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
@@ -36,29 +36,19 @@ import (
 
 	"github.com/sysdb/go/client"
 	"github.com/sysdb/go/proto"
+	"github.com/sysdb/go/sysdb"
 )
 
 func listAll(req request, s *Server) (*page, error) {
-	if len(req.args) != 0 {
-		return nil, fmt.Errorf("%s not found", strings.Title(req.cmd))
-	}
-
-	q, err := client.QueryString("LIST %s", client.Identifier(req.cmd))
-	if err != nil {
-		return nil, err
-	}
-	res, err := s.c.Query(q)
+	res, err := req.id.list(req.cmd)
 	if err != nil {
 		return nil, err
 	}
 	// the template *must* exist
-	return tmpl(s.results[req.cmd], res)
+	return tmpl(s.result(req.inst, req.cmd), res)
 }
 
 func lookup(req request, s *Server) (*page, error) {
-	if req.r.Method != "POST" {
-		return nil, errors.New("Method not allowed")
-	}
 	raw, err := parseQuery(req.r.PostForm.Get("query"))
 	if err != nil {
 		return nil, err
@@ -67,51 +57,26 @@ func lookup(req request, s *Server) (*page, error) {
 	if raw.typ == "" {
 		raw.typ = "hosts"
 	}
-	var args string
-	for name, value := range raw.args {
-		if len(args) > 0 {
-			args += " AND"
-		}
-
-		if name == "name" {
-			args += fmt.Sprintf(" name =~ %s", value)
-		} else {
-			args += fmt.Sprintf(" %s = %s", name, value)
-		}
-	}
-
-	q, err := client.QueryString("LOOKUP %s MATCHING"+args, client.Identifier(raw.typ))
-	if err != nil {
-		return nil, err
-	}
-	res, err := s.c.Query(q)
+	res, err := req.id.lookup(raw.typ, raw)
 	if err != nil {
 		return nil, err
 	}
-	if t, ok := s.results[raw.typ]; ok {
+	if t := s.result(req.inst, raw.typ); t != nil {
 		return tmpl(t, res)
 	}
 	return nil, fmt.Errorf("Unsupported type %s", raw.typ)
 }
 
 func fetch(req request, s *Server) (*page, error) {
-	if len(req.args) == 0 {
-		return nil, fmt.Errorf("%s not found", strings.Title(req.cmd))
-	}
+	host := req.params.get("host")
 
 	var q string
 	var err error
 	switch req.cmd {
 	case "host":
-		if len(req.args) != 1 {
-			return nil, fmt.Errorf("%s not found", strings.Title(req.cmd))
-		}
-		q, err = client.QueryString("FETCH host %s", req.args[0])
+		q, err = client.QueryString("FETCH host %s", host)
 	case "service", "metric":
-		if len(req.args) != 2 {
-			return nil, fmt.Errorf("%s not found", strings.Title(req.cmd))
-		}
-		q, err = client.QueryString("FETCH %s %s.%s", client.Identifier(req.cmd), req.args[0], req.args[1])
+		q, err = client.QueryString("FETCH %s %s.%s", client.Identifier(req.cmd), host, req.params.get("name"))
 	default:
 		panic("Unknown request: fetch(" + req.cmd + ")")
 	}
@@ -119,20 +84,70 @@ func fetch(req request, s *Server) (*page, error) {
 		return nil, err
 	}
 
-	res, err := s.c.Query(q)
+	if err := req.id.visible(host); err != nil {
+		return nil, err
+	}
+	res, err := req.id.Query(q)
 	if err != nil {
 		return nil, err
 	}
+	var p *page
 	if req.cmd == "metric" {
-		return metric(req, res, s)
+		p, err = metric(req, res, s)
+	} else {
+		p, err = tmpl(s.result(req.inst, req.cmd), res)
 	}
-	return tmpl(s.results[req.cmd], res)
+	if err != nil {
+		return nil, err
+	}
+	p.modified = lastUpdate(req.cmd, res)
+	if req.cmd == "host" && !p.modified.IsZero() {
+		// The page includes the recorded changes of the host.
+		if changes := req.inst.hostHistory(host); len(changes) > 0 && changes[0].Time.After(p.modified) {
+			p.modified = changes[0].Time
+		}
+	}
+	return p, nil
+}
+
+// lastUpdate returns the time of the last update of a fetched object and
+// all objects displayed along with it. It returns the zero time for metrics
+// as their page shows a time range ending at the current time.
+func lastUpdate(cmd string, res interface{}) time.Time {
+	h, ok := res.(*sysdb.Host)
+	if !ok {
+		return time.Time{}
+	}
+
+	var last time.Time
+	update := func(t sysdb.Time, attrs []sysdb.Attribute) {
+		if time.Time(t).After(last) {
+			last = time.Time(t)
+		}
+		for _, a := range attrs {
+			if time.Time(a.LastUpdate).After(last) {
+				last = time.Time(a.LastUpdate)
+			}
+		}
+	}
+	switch {
+	case cmd == "host":
+		update(h.LastUpdate, h.Attributes)
+		for _, svc := range h.Services {
+			update(svc.LastUpdate, svc.Attributes)
+		}
+		for _, m := range h.Metrics {
+			update(m.LastUpdate, m.Attributes)
+		}
+	case cmd == "service" && len(h.Services) > 0:
+		update(h.Services[0].LastUpdate, h.Services[0].Attributes)
+	}
+	return last
 }
 
 func graphs(req request, s *Server) (*page, error) {
 	p := struct {
 		Query, Metrics string
-		QueryOptions   string
 		GroupBy        []string
 		Attributes     map[string]bool
 	}{
@@ -142,14 +157,15 @@ func graphs(req request, s *Server) (*page, error) {
 
 	if req.r.Method == "POST" {
 		p.Metrics = p.Query
-		if len(p.GroupBy) > 0 {
-			p.QueryOptions += "/g=" + strings.Join(p.GroupBy, ",")
-		}
 
-		metrics, err := s.queryMetrics(p.Query)
+		metrics, err := req.id.queryMetrics(p.Query)
 		if err != nil {
 			return nil, err
 		}
+		if max := s.limits.cfg.MaxGraphMetrics; max > 0 && len(metrics) > max {
+			return nil, fmt.Errorf("Query matches %d metrics; graphs may include at most %d",
+				len(metrics), max)
+		}
 		p.Attributes = make(map[string]bool)
 		for _, m := range metrics {
 			for a := range m.Attributes {
@@ -164,7 +180,7 @@ func graphs(req request, s *Server) (*page, error) {
 			}
 		}
 	}
-	return tmpl(s.results["graphs"], &p)
+	return tmpl(s.result(req.inst, "graphs"), &p)
 }
 
 var datetime = "2006-01-02 15:04:05"
@@ -200,7 +216,7 @@ func metric(req request, res interface{}, s *Server) (*page, error) {
 		end.Format(urldate),
 		res,
 	}
-	return tmpl(s.results["metric"], &p)
+	return tmpl(s.result(req.inst, "metric"), &p)
 }
 
 type query struct {
@@ -227,6 +243,34 @@ func (q *query) attr(parent, name, value string) error {
 	return q.arg(k, value)
 }
 
+// filter returns the query's arguments formatted as a SysDB filter
+// expression suitable for use in a MATCHING clause.
+func (q *query) filter() string {
+	return q.expr("")
+}
+
+// expr formats the query's arguments as a SysDB filter expression. If parent
+// is not empty, all arguments refer to the parent object of the queried
+// objects (e.g. the host of a service).
+func (q *query) expr(parent string) string {
+	var args string
+	for name, value := range q.args {
+		if len(args) > 0 {
+			args += " AND"
+		}
+
+		if parent != "" && !strings.HasPrefix(name, parent+".") {
+			name = parent + "." + name
+		}
+		if name == "name" || name == parent+".name" {
+			args += fmt.Sprintf(" %s =~ %s", name, value)
+		} else {
+			args += fmt.Sprintf(" %s = %s", name, value)
+		}
+	}
+	return args
+}
+
 func parseQuery(s string) (*query, error) {
 	tokens, err := tokenize(s)
 	if err != nil {
@@ -0,0 +1,70 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sysdb/go/sysdb"
+)
+
+func TestLastUpdate(t *testing.T) {
+	at := func(min int) sysdb.Time {
+		return sysdb.Time(time.Date(2014, 12, 1, 13, min, 0, 0, time.UTC))
+	}
+	h := &sysdb.Host{
+		Name:       "a",
+		LastUpdate: at(10),
+		Attributes: []sysdb.Attribute{{Name: "arch", LastUpdate: at(20)}},
+		Services: []sysdb.Service{
+			{Name: "sshd", LastUpdate: at(15), Attributes: []sysdb.Attribute{{Name: "port", LastUpdate: at(30)}}},
+			{Name: "ntpd", LastUpdate: at(40)},
+		},
+		Metrics: []sysdb.Metric{{Name: "load", LastUpdate: at(50)}},
+	}
+	svc := &sysdb.Host{Name: "a", LastUpdate: at(10), Services: h.Services[:1]}
+	metric := &sysdb.Host{Name: "a", LastUpdate: at(10), Metrics: h.Metrics}
+
+	for _, test := range []struct {
+		cmd  string
+		res  interface{}
+		want sysdb.Time
+	}{
+		{"host", h, at(50)},
+		{"host", &sysdb.Host{Name: "a", LastUpdate: at(10)}, at(10)},
+		{"service", svc, at(30)},
+		{"service", &sysdb.Host{Name: "a"}, sysdb.Time{}},
+		{"metric", metric, sysdb.Time{}},
+		{"host", []sysdb.Host{*h}, sysdb.Time{}},
+	} {
+		if got := lastUpdate(test.cmd, test.res); !got.Equal(time.Time(test.want)) {
+			t.Errorf("lastUpdate(%s, %v) = %v; want %v", test.cmd, test.res, got, time.Time(test.want))
+		}
+	}
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
@@ -0,0 +1,231 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+// Routing of requests to handlers.
+//
+// Routes are declared using patterns consisting of path segments separated
+// by slashes (relative to the root mount point):
+//
+//	host/:name                   ":name" matches any single segment
+//	graph/:host/:metric/:start?  a trailing '?' marks a parameter as optional
+//	compare/*hosts               "*hosts" matches all remaining segments
+//
+// Segments are unescaped individually such that they may contain escaped
+// slashes. The first segment of a pattern names the route; it's used to
+// look up access rules and in metrics and the access log.
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// A route maps requests matching a pattern to a handler.
+type route struct {
+	pattern string
+	// methods lists the accepted HTTP methods. GET implies HEAD.
+	methods []string
+	h       handler
+
+	name     string
+	segments []string
+}
+
+// params holds the values of the named parameters of a route. Wildcard
+// parameters may have any number of values, all others have exactly one.
+type params map[string][]string
+
+// get returns the value of the named parameter or an empty string if it
+// was not specified.
+func (p params) get(name string) string {
+	if v := p[name]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// A router dispatches requests according to a list of routes. The first
+// matching route wins.
+type router struct {
+	routes []*route
+}
+
+// Methods commonly accepted by routes.
+var (
+	get     = []string{http.MethodGet}
+	getPost = []string{http.MethodGet, http.MethodPost}
+)
+
+// errMethod reports that a route matched the path but not the method.
+type errMethod struct {
+	allowed []string
+}
+
+func (e *errMethod) Error() string {
+	return fmt.Sprintf("Method not allowed; use %s", strings.Join(e.allowed, ", "))
+}
+
+var errNoRoute = errors.New("No matching route")
+
+// newRouter validates all patterns and constructs a router.
+func newRouter(routes []route) (*router, error) {
+	rt := &router{}
+	for _, r := range routes {
+		r := r
+		r.segments = splitPath(r.pattern)
+		optional := false
+		for i, seg := range r.segments {
+			switch {
+			case seg == "":
+				return nil, fmt.Errorf("Invalid route %q: empty segment", r.pattern)
+			case seg[0] == '*' && i != len(r.segments)-1:
+				return nil, fmt.Errorf("Invalid route %q: wildcard has to be last", r.pattern)
+			case seg[0] == ':' && strings.HasSuffix(seg, "?"):
+				optional = true
+			case optional:
+				return nil, fmt.Errorf("Invalid route %q: optional parameters have to be last", r.pattern)
+			}
+		}
+		if len(r.segments) > 0 && r.segments[0][0] != ':' && r.segments[0][0] != '*' {
+			r.name = r.segments[0]
+		}
+		if len(r.methods) == 0 {
+			return nil, fmt.Errorf("Invalid route %q: no methods", r.pattern)
+		}
+		rt.routes = append(rt.routes, &r)
+	}
+	return rt, nil
+}
+
+// splitPath splits a path into its segments, ignoring leading and trailing
+// slashes.
+func splitPath(path string) []string {
+	path = strings.TrimSuffix(strings.TrimPrefix(path, "/"), "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// match finds the route matching the specified method and escaped path. It
+// returns an *errMethod if the path matches routes which do not accept the
+// method and errNoRoute if it does not match any route.
+func (rt *router) match(method, path string) (*route, params, error) {
+	segments := splitPath(path)
+	for i, seg := range segments {
+		s, err := url.PathUnescape(seg)
+		if err != nil {
+			return nil, nil, err
+		}
+		segments[i] = s
+	}
+
+	var allowed []string
+	for _, r := range rt.routes {
+		p, ok := r.matchPath(segments)
+		if !ok {
+			continue
+		}
+		if r.accepts(method) {
+			return r, p, nil
+		}
+		allowed = append(allowed, r.methods...)
+	}
+	if len(allowed) == 0 {
+		return nil, nil, errNoRoute
+	}
+	return nil, nil, &errMethod{allowed: allowedMethods(allowed)}
+}
+
+func (r *route) accepts(method string) bool {
+	for _, m := range r.methods {
+		if m == method || m == http.MethodGet && method == http.MethodHead {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *route) matchPath(segments []string) (params, bool) {
+	p := params{}
+	for i, pat := range r.segments {
+		switch {
+		case pat[0] == '*':
+			p[pat[1:]] = segments[i:]
+			return p, true
+		case i >= len(segments):
+			if pat[0] == ':' && strings.HasSuffix(pat, "?") {
+				continue
+			}
+			return nil, false
+		case pat[0] == ':':
+			p[strings.TrimSuffix(pat[1:], "?")] = segments[i : i+1]
+		case pat != segments[i]:
+			return nil, false
+		}
+	}
+	if len(segments) > len(r.segments) {
+		return nil, false
+	}
+	return p, true
+}
+
+// allowedMethods returns the sorted list of unique methods, including HEAD
+// if GET is allowed.
+func allowedMethods(methods []string) []string {
+	seen := make(map[string]bool)
+	var list []string
+	for _, m := range methods {
+		ms := []string{m}
+		if m == http.MethodGet {
+			ms = append(ms, http.MethodHead)
+		}
+		for _, m := range ms {
+			if !seen[m] {
+				seen[m] = true
+				list = append(list, m)
+			}
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// has checks whether the router has a route with the specified name.
+func (rt *router) has(name string) bool {
+	for _, r := range rt.routes {
+		if r.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
@@ -0,0 +1,131 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	var routes []route
+	for _, r := range []struct {
+		pattern string
+		methods []string
+	}{
+		{"", get},
+		{"hosts", get},
+		{"host/:host", get},
+		{"lookup", []string{http.MethodPost}},
+		{"graphs", getPost},
+		{"compare/*hosts", get},
+		{"graph/q/:query/:start?/:end?", get},
+		{"graph/:host/:metric/:start?/:end?", get},
+	} {
+		routes = append(routes, route{pattern: r.pattern, methods: r.methods, h: func(http.ResponseWriter, request) {}})
+	}
+	rt, err := newRouter(routes)
+	if err != nil {
+		t.Fatalf("newRouter() = %v; want <nil>", err)
+	}
+
+	for _, test := range []struct {
+		method, path string
+		pattern      string
+		params       params
+		err          error
+	}{
+		{"GET", "", "", params{}, nil},
+		{"GET", "/", "", params{}, nil},
+		{"HEAD", "hosts", "hosts", params{}, nil},
+		{"GET", "hosts/", "hosts", params{}, nil},
+		{"GET", "hosts/a", "", nil, errNoRoute},
+		{"GET", "host/a+b%20c", "host/:host", params{"host": {"a+b c"}}, nil},
+		{"GET", "host/a%2Fb", "host/:host", params{"host": {"a/b"}}, nil},
+		{"GET", "host", "", nil, errNoRoute},
+		{"POST", "host/a", "", nil, &errMethod{allowed: []string{"GET", "HEAD"}}},
+		{"GET", "lookup", "", nil, &errMethod{allowed: []string{"POST"}}},
+		{"POST", "graphs", "graphs", params{}, nil},
+		{"GET", "compare", "compare/*hosts", params{"hosts": {}}, nil},
+		{"GET", "compare/a/b", "compare/*hosts", params{"hosts": {"a", "b"}}, nil},
+		{"GET", "graph/q/name%20%3D%20'x'", "graph/q/:query/:start?/:end?",
+			params{"query": {"name = 'x'"}}, nil},
+		{"GET", "graph/h/m/20141201000000", "graph/:host/:metric/:start?/:end?",
+			params{"host": {"h"}, "metric": {"m"}, "start": {"20141201000000"}}, nil},
+		{"GET", "graph/h/m/1/2/3", "", nil, errNoRoute},
+		{"GET", "graph/h", "", nil, errNoRoute},
+	} {
+		r, p, err := rt.match(test.method, test.path)
+		if !reflect.DeepEqual(err, test.err) {
+			t.Errorf("match(%s, %q) = %v; want %v", test.method, test.path, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if r.pattern != test.pattern || !reflect.DeepEqual(p, test.params) {
+			t.Errorf("match(%s, %q) = %q, %v; want %q, %v",
+				test.method, test.path, r.pattern, p, test.pattern, test.params)
+		}
+	}
+
+	if _, _, err := rt.match("GET", "host/%zz"); err == nil {
+		t.Errorf("match(GET, %q) = <nil>; want error", "host/%zz")
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	rt, err := newRouter((&Server{}).routes())
+	if err != nil {
+		t.Fatalf("newRouter(routes()) = %v; want <nil>", err)
+	}
+
+	// State-changing requests must not be possible using GET.
+	for _, path := range []string{"lookup", "logout"} {
+		want := &errMethod{allowed: []string{"POST"}}
+		if _, _, err := rt.match("GET", path); !reflect.DeepEqual(err, want) {
+			t.Errorf("match(GET, %q) = %v; want %v", path, err, want)
+		}
+		if _, _, err := rt.match("POST", path); err != nil {
+			t.Errorf("match(POST, %q) = %v; want <nil>", path, err)
+		}
+	}
+}
+
+func TestNewRouter(t *testing.T) {
+	for _, pattern := range []string{
+		"a//b",
+		"a/*b/c",
+		"a/:b?/c",
+	} {
+		if _, err := newRouter([]route{{pattern: pattern, methods: get}}); err == nil {
+			t.Errorf("newRouter(%q) = <nil>; want error", pattern)
+		}
+	}
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
@@ -28,97 +28,485 @@ package server
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
 	"log"
 	"net/http"
-	"net/url"
-	"path/filepath"
+	"path"
 	"strings"
-
-	"github.com/sysdb/go/client"
+	"sync"
+	"time"
 )
 
-// A Config specifies configuration values for a SysDB web server.
+// A Config specifies configuration values for a SysDB web server. The root
+// mount point, the SysDB instances, and the snapshot settings cannot be
+// changed when reloading the configuration.
 type Config struct {
-	// TemplatePath specifies the relative or absolute location of template files.
+	// TemplatePath specifies the relative or absolute location of template
+	// files. Templates found in this location take precedence over those
+	// provided by Templates.
 	TemplatePath string
 
-	// StaticPath specifies the relative or absolute location of static files.
+	// Templates provides the default template files (optional).
+	Templates fs.FS
+
+	// StaticPath specifies the relative or absolute location of static
+	// files. Files found in this location take precedence over those provided
+	// by Static.
 	StaticPath string
 
+	// Static provides the default static files (optional).
+	Static fs.FS
+
+	// Theme specifies a directory overriding individual templates and static
+	// files using its "templates" and "static" subdirectories. TemplatePath
+	// and StaticPath take precedence over the theme.
+	Theme string
+
+	// Branding customizes the appearance of the user interface.
+	Branding Branding
+
 	// Root mount point of the server.
 	Root string
+
+	// Instances specifies multiple SysDB servers, overriding the address and
+	// user passed to New. The first instance is the default.
+	Instances []Instance
+
+	// Federated enables the "all" instance which merges the results of all
+	// instances.
+	Federated bool
+
+	// SnapshotPath specifies the directory used to store snapshots of the
+	// inventory. The history of the inventory is not tracked if empty.
+	SnapshotPath string
+
+	// SnapshotInterval specifies the interval between two snapshots
+	// (default: 1 hour).
+	SnapshotInterval time.Duration
+
+	// HistorySize specifies the maximum number of changes of the inventory
+	// kept in the history (default: 10000). Older changes are discarded.
+	HistorySize int
+
+	// Auth specifies the authentication provider used to identify users.
+	// All users have access to the whole user interface if nil.
+	Auth Authenticator
+
+	// Identities maps web users to their SysDB identities. Users without an
+	// entry use the identity of user "*". Users are denied access if neither
+	// exists. All users share the server's connection if nil.
+	Identities map[string]Identity
+
+	// Admins lists the users allowed to administer the server, e.g. to
+	// flush the query cache. Administration requires authentication.
+	Admins []string
+
+	// HSTS specifies the max-age of the Strict-Transport-Security header
+	// sent with responses to HTTPS requests. The header is omitted if zero.
+	HSTS time.Duration
+
+	// Headers specifies security headers (e.g. Content-Security-Policy) sent
+	// with all responses. DefaultHeaders are used if nil. Headers with an
+	// empty value are omitted.
+	Headers map[string]string
+
+	// Dev enables development mode: templates are parsed again whenever a
+	// file in TemplatePath changes and template errors are reported in the
+	// browser rather than failing to start the server.
+	Dev bool
+
+	// Cache specifies the query cache settings. It cannot be changed when
+	// reloading the configuration.
+	Cache CacheConfig
+
+	// ReadyTimeout specifies the maximum time to wait for SysDB when checking
+	// readiness (default: 2 seconds).
+	ReadyTimeout time.Duration
+
+	// AccessLog specifies the destination of the access log. Requests are
+	// not logged if nil. Each entry includes the SysDB queries issued while
+	// serving the request along with their duration.
+	AccessLog io.Writer
+
+	// AccessLogFormat specifies the format of the access log, either
+	// LogText (default) or LogJSON.
+	AccessLogFormat string
+
+	// Limits specifies rate limits and concurrency caps of expensive
+	// requests. They cannot be changed when reloading the configuration.
+	Limits LimitConfig
+
+	// ClientHeader specifies a header (e.g. X-Forwarded-For) identifying the
+	// client of requests received on Unix domain sockets, which carry no
+	// client address. The header is trusted because only a local reverse
+	// proxy is able to connect to the socket; it is ignored on TCP
+	// connections. Without it, such clients are not rate limited
+	// individually and are logged as "-".
+	ClientHeader string
+
+	// MetricsPublic allows anybody to access the metrics served by the
+	// handler returned by Metrics. Otherwise, they are subject to the same
+	// authentication as the user interface.
+	MetricsPublic bool
 }
 
 // A Server implements an http.Handler that serves the SysDB user interface.
 type Server struct {
-	c *client.Client
+	// SysDB instances; the first one is the default.
+	instances []*instance
 
-	// Request multiplexer
-	mux map[string]handler
+	// Routes of all requests.
+	router *router
 
-	// Templates:
-	main    *template.Template
-	results map[string]*template.Template
-
-	// Base directory of static files.
-	basedir string
+	// Settings which may be changed by Reload, protected by mu. The lock is
+	// held only to access the pointer; settings are never modified in place.
+	mu  sync.RWMutex
+	cur *settings
 
 	// Root mount point.
 	root string
+
+	// Closed to stop all background tasks.
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	// Secret key used to derive CSRF tokens.
+	csrfKey []byte
+
+	// Query cache (optional).
+	cache *cache
+
+	// Limits of expensive requests.
+	limits *limiter
+
+	// Self-monitoring metrics.
+	metrics *metrics
+
+	// Serializes writes to the access log.
+	logMu sync.Mutex
+}
+
+// settings holds the configuration applied by Reload.
+type settings struct {
+	// Templates of all instances.
+	templates map[string]*templateSet
+
+	// Development mode (see Config.Dev).
+	dev *devMode
+
+	// Static files.
+	files fs.FS
+
+	// Branding with default values applied.
+	site *Branding
+
+	// Authentication provider and sessions of logged in users (optional).
+	auth     Authenticator
+	sessions *sessions
+
+	// SysDB identities of web users (optional).
+	identities map[string]access
+
+	// Users allowed to administer the server.
+	admins map[string]bool
+
+	// max-age of HTTP Strict Transport Security.
+	hsts time.Duration
+
+	// Security headers sent with all responses.
+	headers map[string]string
+
+	// Timeout of readiness checks.
+	readyTimeout time.Duration
+
+	// Access log (optional).
+	accessLog io.Writer
+	logFormat string
+
+	// Header identifying clients on Unix domain sockets (optional).
+	clientHeader string
+
+	// Serve metrics without authentication.
+	metricsPublic bool
+}
+
+// settings returns the current settings. They remain valid even if the
+// configuration is reloaded concurrently.
+func (s *Server) settings() *settings {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cur
 }
 
 // New constructs a new SysDB web server using the specified configuration.
 func New(addr, user string, cfg Config) (*Server, error) {
 	s := &Server{
-		results: make(map[string]*template.Template),
-		basedir: cfg.StaticPath,
 		root:    cfg.Root,
+		done:    make(chan struct{}),
+		metrics: newMetrics(),
+		cache:   newCache(cfg.Cache),
+		limits:  newLimiter(cfg.Limits),
 	}
 	if s.root == "" {
 		s.root = "/"
 	}
+	if err := validateInstances(cfg.Instances); err != nil {
+		return nil, err
+	}
+	s.newInstances(addr, user, cfg)
+	if err := s.Reload(cfg); err != nil {
+		return nil, err
+	}
 
 	var err error
-	if s.c, err = client.Connect(addr, user); err != nil {
+	if s.csrfKey, err = newCSRFKey(); err != nil {
+		return nil, fmt.Errorf("Failed to generate CSRF key: %v", err)
+	}
+	if err = s.connect(addr, user, cfg); err != nil {
+		s.Close()
 		return nil, err
 	}
-	if major, minor, patch, extra, err := s.c.ServerVersion(); err == nil {
-		log.Printf("Connected to SysDB %d.%d.%d%s.", major, minor, patch, extra)
+
+	if s.router, err = newRouter(s.routes()); err != nil {
+		return nil, err
+	}
+
+	interval := cfg.SnapshotInterval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	for _, inst := range s.instances {
+		if inst.history == nil {
+			continue
+		}
+		s.wg.Add(1)
+		go func(inst *instance) {
+			defer s.wg.Done()
+			s.snapshots(inst, interval, s.done)
+		}(inst)
+	}
+	return s, nil
+}
+
+// Templates used to render the results of the various commands.
+var templates = []string{
+	"cache", "changes", "compare", "graphs", "host", "hosts", "login", "logout",
+	"service", "services", "metric", "metrics", "pivot", "topology",
+}
+
+// Validate checks the configuration without connecting to SysDB. It parses
+// all templates and identities.
+func (cfg Config) Validate() error {
+	if cfg.Root != "" && !strings.HasPrefix(cfg.Root, "/") {
+		return fmt.Errorf("Invalid root mount point %q: must start with '/'", cfg.Root)
+	}
+	if cfg.SnapshotInterval < 0 {
+		return fmt.Errorf("Invalid snapshot interval %v", cfg.SnapshotInterval)
+	}
+	if cfg.HistorySize < 0 {
+		return fmt.Errorf("Invalid history size %d", cfg.HistorySize)
+	}
+	if f := cfg.AccessLogFormat; f != "" && f != LogText && f != LogJSON {
+		return fmt.Errorf("Invalid access log format %q", f)
+	}
+	if l := cfg.Limits; l.Rate < 0 || l.Burst < 0 || l.Concurrency < 0 || l.MaxGraphMetrics < 0 {
+		return fmt.Errorf("Invalid limits: values must not be negative")
 	}
+	if err := validateInstances(cfg.Instances); err != nil {
+		return err
+	}
+	// Report template errors even in development mode.
+	cfg.Dev = false
+	s := &Server{root: "/"}
+	return s.Reload(cfg)
+}
+
+// Reload applies the specified configuration to a running server. All
+// templates are parsed again. The previous configuration remains in place if
+// the new one is invalid. Reload does not wait for requests being served at
+// the time of the call.
+func (s *Server) Reload(cfg Config) error {
+	themeTmpl, themeStatic, err := themeDirs(cfg.Theme)
+	if err != nil {
+		return fmt.Errorf("Invalid theme: %v", err)
+	}
+	tmplFS, err := newOverlay(cfg.Templates, cfg.TemplatePath, themeTmpl)
+	if err != nil {
+		return fmt.Errorf("Invalid template location: %v", err)
+	}
+	static, err := newOverlay(cfg.Static, cfg.StaticPath, themeStatic)
+	if err != nil {
+		return fmt.Errorf("Invalid static files location: %v", err)
+	}
+
+	var dev *devMode
+	if cfg.Dev {
+		dev = &devMode{dir: cfg.TemplatePath, fsys: tmplFS}
+		dev.state, _ = dirState(dev.dir)
+	}
+	tmpls, err := s.parseAll(tmplFS)
+	if err != nil {
+		if dev == nil {
+			return err
+		}
+		log.Printf("Template error: %v", err)
+		dev.err = err
+	}
+	identities, err := parseIdentities(cfg.Identities)
+	if err != nil {
+		return err
+	}
+
+	set := &settings{
+		templates:     tmpls,
+		dev:           dev,
+		files:         static,
+		site:          cfg.Branding.resolve(s.Root()),
+		auth:          cfg.Auth,
+		identities:    identities,
+		admins:        make(map[string]bool, len(cfg.Admins)),
+		hsts:          cfg.HSTS,
+		headers:       cfg.Headers,
+		readyTimeout:  cfg.ReadyTimeout,
+		accessLog:     cfg.AccessLog,
+		logFormat:     cfg.AccessLogFormat,
+		clientHeader:  cfg.ClientHeader,
+		metricsPublic: cfg.MetricsPublic,
+	}
+	if set.headers == nil {
+		set.headers = DefaultHeaders
+	}
+	if csp := set.headers["Content-Security-Policy"]; csp != "" {
+		if c := allowImages(csp, set.site.Logo); c != csp {
+			headers := make(map[string]string, len(set.headers))
+			for name, value := range set.headers {
+				headers[name] = value
+			}
+			headers["Content-Security-Policy"] = c
+			set.headers = headers
+		}
+	}
+	for _, user := range cfg.Admins {
+		set.admins[user] = true
+	}
+	if set.readyTimeout <= 0 {
+		set.readyTimeout = 2 * time.Second
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.cur
+	if old == nil {
+		old = &settings{}
+	}
+	if tmpls == nil {
+		set.templates = old.templates
+	}
+	if _, ok := cfg.Auth.(PasswordAuthenticator); ok {
+		// Sessions remain valid across reloads.
+		if set.sessions = old.sessions; set.sessions == nil {
+			if set.sessions, err = newSessions(); err != nil {
+				return fmt.Errorf("Failed to generate session key: %v", err)
+			}
+		}
+	}
+	s.cur = set
+	return nil
+}
 
-	if s.main, err = cfg.parse(s, "main.tmpl"); err != nil {
+// Close stops all background tasks and closes all connections to SysDB. The
+// server must not be used after calling Close.
+func (s *Server) Close() {
+	close(s.done)
+	s.wg.Wait()
+
+	for _, inst := range s.instances {
+		if inst.pool != nil {
+			inst.pool.close()
+		}
+		if inst.c != nil {
+			inst.c.Close()
+		}
+	}
+}
+
+// A templateSet holds the main template and all result templates.
+type templateSet struct {
+	main    *template.Template
+	results map[string]*template.Template
+}
+
+// parseAll parses the main template and all result templates. The templates
+// are cloned for each instance such that they link to the pages of the
+// instance.
+func (s *Server) parseAll(fsys fs.FS) (map[string]*templateSet, error) {
+	set := &templateSet{results: make(map[string]*template.Template, len(templates))}
+	var err error
+	if set.main, err = s.parse(fsys, "main.tmpl"); err != nil {
 		return nil, err
 	}
-	types := []string{"graphs", "host", "hosts", "service", "services", "metric", "metrics"}
-	for _, t := range types {
-		s.results[t], err = cfg.parse(s, t+".tmpl")
-		if err != nil {
+	for _, t := range templates {
+		if set.results[t], err = s.parse(fsys, t+".tmpl"); err != nil {
 			return nil, err
 		}
 	}
 
-	s.mux = map[string]handler{
-		"images": s.static,
-		"style":  s.static,
-		"graph":  s.graph,
+	sets := map[string]*templateSet{"": set}
+	for _, inst := range s.instances {
+		if sets[inst.name], err = set.clone(inst.funcs()); err != nil {
+			return nil, err
+		}
 	}
-	return s, nil
+	return sets, nil
 }
 
-func (cfg Config) parse(s *Server, name string) (*template.Template, error) {
-	t := template.New(filepath.Base(name)).Funcs(template.FuncMap{
-		"root": s.Root,
-	})
-	return t.ParseFiles(filepath.Join(cfg.TemplatePath, name))
+// clone returns a copy of the templates using the specified functions.
+func (set *templateSet) clone(funcs template.FuncMap) (*templateSet, error) {
+	c := &templateSet{results: make(map[string]*template.Template, len(set.results))}
+	var err error
+	if c.main, err = set.main.Clone(); err != nil {
+		return nil, err
+	}
+	c.main.Funcs(funcs)
+	for name, t := range set.results {
+		if c.results[name], err = t.Clone(); err != nil {
+			return nil, err
+		}
+		c.results[name].Funcs(funcs)
+	}
+	return c, nil
+}
+
+// result returns the named result template of an instance.
+func (s *Server) result(inst *instance, name string) *template.Template {
+	return s.settings().templates[inst.name].results[name]
+}
+
+func (s *Server) parse(fsys fs.FS, name string) (*template.Template, error) {
+	t := template.New(path.Base(name)).Funcs(s.funcs())
+	return t.ParseFS(fsys, name)
 }
 
 type request struct {
-	r    *http.Request
-	cmd  string
-	args []string
+	r *http.Request
+	// Instance of SysDB serving the request.
+	inst *instance
+	// Name of the route and its parameters.
+	cmd    string
+	params params
+
+	// Authenticated user, if any.
+	user string
+
+	// SysDB identity used for all queries.
+	id *identity
 }
 
 type handler func(http.ResponseWriter, request)
@@ -126,104 +514,279 @@ type handler func(http.ResponseWriter, request)
 type page struct {
 	Title   string
 	Query   string
+	User    string
+	Site    *Branding
 	Content template.HTML
+
+	// Instance selector (optional).
+	Instances []instanceLink
+
+	// Problems which did not prevent showing the page (optional).
+	Warnings []string
+
+	// Time of the last modification of the displayed object (optional).
+	modified time.Time
+}
+
+// Commands which do not use any templates.
+var noTemplates = map[string]bool{
+	"images":  true,
+	"style":   true,
+	"healthz": true,
+	"readyz":  true,
 }
 
-// Content generators for HTML pages.
-var content = map[string]func(request, *Server) (*page, error){
-	"": index,
-
-	// Queries
-	"graphs":   graphs,
-	"host":     fetch,
-	"service":  fetch,
-	"metric":   fetch,
-	"hosts":    listAll,
-	"services": listAll,
-	"metrics":  listAll,
-	"lookup":   lookup,
+// routes returns the routes of all requests served by the server.
+func (s *Server) routes() []route {
+	return []route{
+		{pattern: "", methods: get, h: s.page(index)},
+
+		{pattern: "images/*file", methods: get, h: s.static},
+		{pattern: "style/*file", methods: get, h: s.static},
+		{pattern: "login", methods: getPost, h: s.login},
+		{pattern: "logout", methods: []string{http.MethodPost}, h: s.logout},
+		{pattern: "healthz", methods: get, h: s.healthz},
+		{pattern: "readyz", methods: get, h: s.readyz},
+
+		{pattern: "cache", methods: getPost, h: s.page(cachePage)},
+
+		// Queries
+		{pattern: "changes", methods: get, h: s.page(changes)},
+		{pattern: "compare/*hosts", methods: get, h: s.page(compare)},
+		{pattern: "graphs", methods: getPost, h: s.page(graphs)},
+		{pattern: "host/:host", methods: get, h: s.page(fetch)},
+		{pattern: "service/:host/:name", methods: get, h: s.page(fetch)},
+		{pattern: "metric/:host/:name", methods: getPost, h: s.page(fetch)},
+		{pattern: "hosts", methods: get, h: s.page(listAll)},
+		{pattern: "services", methods: get, h: s.page(listAll)},
+		{pattern: "metrics", methods: get, h: s.page(listAll)},
+		{pattern: "lookup", methods: []string{http.MethodPost}, h: s.page(lookup)},
+		{pattern: "pivot", methods: get, h: s.page(pivot)},
+		{pattern: "pivot.csv", methods: get, h: s.pivotCSV},
+		{pattern: "topology/:host", methods: get, h: s.page(topologyPage)},
+		{pattern: "topology.dot/:host", methods: get, h: s.topologyDOT},
+		{pattern: "export/:format", methods: get, h: s.export},
+
+		// Graphs of a single metric or of all metrics matching a query.
+		{pattern: "graph/q/:query/:start?/:end?", methods: get, h: s.graph},
+		{pattern: "graph/:host/:metric/:start?/:end?", methods: get, h: s.graph},
+	}
 }
 
 // ServeHTTP implements the http.Handler interface and serves
 // the SysDB user interface.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	path := r.RequestURI
+	s.refresh()
+	s.handle(w, r, s.serve)
+}
+
+// handle serves a request using f and records it in the metrics and the
+// access log.
+func (s *Server) handle(w http.ResponseWriter, r *http.Request,
+	f func(http.ResponseWriter, *http.Request, *settings, *accessEntry)) {
+	set := s.settings()
+
+	e := &accessEntry{
+		id:     newRequestID(),
+		start:  time.Now(),
+		remote: clientAddr(r, set.clientHeader),
+	}
+	w.Header().Set(requestIDHeader, e.id)
+	sw := &statusWriter{ResponseWriter: w}
+	s.metrics.begin()
+	f(sw, r, set, e)
+	status := sw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	s.metrics.end(s.handlerName(e.handler), status, time.Since(e.start))
+
+	if set.accessLog != nil {
+		s.logMu.Lock()
+		err := writeAccess(set.accessLog, set.logFormat, r, sw, e, time.Now())
+		s.logMu.Unlock()
+		if err != nil {
+			log.Printf("Failed to write access log: %v", err)
+		}
+	}
+}
+
+// serve handles a request using the specified settings, recording
+// information for the access log in e.
+func (s *Server) serve(w http.ResponseWriter, r *http.Request, set *settings, e *accessEntry) {
+	if set.hsts > 0 && r.TLS != nil {
+		w.Header().Set("Strict-Transport-Security",
+			fmt.Sprintf("max-age=%d", int64(set.hsts/time.Second)))
+	}
+	for name, value := range set.headers {
+		if value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+
+	path := r.URL.EscapedPath()
 	if !strings.HasPrefix(path, s.root) {
+		e.handler = "other"
 		s.notfound(w, r)
 		return
 	}
 	path = strings.TrimPrefix(path, s.root)
 	r.URL.Path = strings.TrimPrefix(r.URL.Path, s.root)
 
-	if len(path) > 0 && path[0] == '/' {
-		path = path[1:]
+	inst, rest := s.splitInstance(path)
+	if rest != path {
+		// Instance names don't need to be escaped.
+		r.URL.Path = strings.TrimPrefix(r.URL.Path[len(inst.name):], "/")
+		path = rest
 	}
-	if idx := strings.Index(path, "?"); idx != -1 {
-		path = path[:idx]
+	if inst.name != "" {
+		w.Header().Set(instanceHeader, inst.name)
 	}
-	var fields []string
-	for _, f := range strings.Split(path, "/") {
-		f, err := url.QueryUnescape(f)
-		if err != nil {
-			s.badrequest(w, fmt.Errorf("Error: %v", err))
-			return
+
+	rt, params, err := s.router.match(r.Method, path)
+	if err != nil {
+		e.handler = "other"
+		if me, ok := err.(*errMethod); ok {
+			w.Header().Set("Allow", strings.Join(me.allowed, ", "))
+			s.err(w, http.StatusMethodNotAllowed, me)
+		} else if err == errNoRoute {
+			s.notfound(w, r)
+		} else {
+			s.badrequest(w, fmt.Errorf("Invalid path: %v", err))
 		}
-		fields = append(fields, f)
+		return
 	}
+	e.handler = rt.name
 
-	req := request{
-		r:   r,
-		cmd: fields[0],
+	if set.dev != nil && set.dev.err != nil && !noTemplates[rt.name] {
+		set.dev.report(w)
+		return
 	}
-	if len(fields) > 1 {
-		if fields[len(fields)-1] == "" {
-			// Slash at the end of the URL
-			fields = fields[:len(fields)-1]
-		}
-		if len(fields) > 1 {
-			req.args = fields[1:]
+
+	if !noTemplates[rt.name] {
+		token := s.csrfToken(w, r)
+		w.Header().Set(csrfHeader, token)
+		if !checkCSRF(r, token) {
+			s.err(w, http.StatusForbidden,
+				errors.New("Invalid or missing CSRF token; please reload the page and try again"))
+			return
 		}
 	}
 
-	if h := s.mux[fields[0]]; h != nil {
-		h(w, req)
+	user, ok := s.authenticate(w, r, set, rt.name)
+	if !ok {
 		return
 	}
 
-	f, ok := content[req.cmd]
-	if !ok {
-		s.notfound(w, r)
+	e.user = user
+
+	id, err := s.identity(set, inst, user)
+	if err != nil && !public[rt.name] {
+		s.err(w, http.StatusForbidden, err)
 		return
 	}
-	r.ParseForm()
-	p, err := f(req, s)
-	if err != nil {
-		p = &page{
-			Content: "<section class=\"error\">" +
-				html(fmt.Sprintf("Error: %v", err)) +
-				"</section>",
+	if id != nil {
+		id.log = e
+	}
+
+	if expensive[rt.name] {
+		release, err := s.limits.acquire(r.Context(), clientName(e.remote, user))
+		if err != nil {
+			if le, ok := err.(*limitError); ok {
+				s.toomany(w, le)
+			} else {
+				s.err(w, http.StatusServiceUnavailable, err)
+			}
+			return
+		}
+		defer release()
+	}
+
+	rt.h(w, request{
+		r:      r,
+		inst:   inst,
+		cmd:    rt.name,
+		params: params,
+		user:   user,
+		id:     id,
+	})
+}
+
+// page returns a handler rendering the HTML page generated by f using the
+// main template.
+func (s *Server) page(f func(request, *Server) (*page, error)) handler {
+	return func(w http.ResponseWriter, req request) {
+		req.r.ParseForm()
+		p, err := f(req, s)
+		if err != nil {
+			p = &page{
+				Content: "<section class=\"error\">" +
+					html(fmt.Sprintf("Error: %v", err)) +
+					"</section>",
+			}
+		}
+
+		p.Query = req.r.FormValue("query")
+		p.User = req.user
+		if req.id != nil {
+			p.Warnings = req.id.warnings.list()
 		}
+		s.render(w, req.r, http.StatusOK, p)
 	}
+}
 
-	p.Query = r.FormValue("query")
+// render writes a page using the main template. If the request is not nil
+// and the status is 200, the response carries an ETag and conditional
+// requests are handled.
+func (s *Server) render(w http.ResponseWriter, r *http.Request, status int, p *page) {
 	if p.Title == "" {
-		p.Title = "SysDB - The System Database"
+		p.Title = "The System Database"
+	}
+	set := s.settings()
+	p.Site = set.site
+
+	if set.templates == nil {
+		// Templates failed to parse in development mode.
+		set.dev.report(w)
+		return
 	}
+	inst := s.instance(w.Header().Get(instanceHeader))
+	p.Instances = s.links(inst)
 
 	var buf bytes.Buffer
-	err = s.main.Execute(&buf, p)
+	err := set.templates[inst.name].main.Execute(&buf, p)
 	if err != nil {
-		s.internal(w, err)
+		// Nothing more we can do about this.
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	body := bytes.ReplaceAll(buf.Bytes(), []byte(csrfPlaceholder),
+		[]byte(w.Header().Get(csrfHeader)))
+
+	if r != nil && status == http.StatusOK {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		// Pages are personalized and show current data.
+		w.Header().Set("Cache-Control", "private, no-cache")
+		serveBody(w, r, body, p.modified)
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
 
-	w.WriteHeader(http.StatusOK)
-	io.Copy(w, &buf)
+// serveBody writes a response body along with an ETag computed from the
+// body and the time of the last modification, if known. It handles
+// conditional and range requests. The Content-Type header has to be set by
+// the caller.
+func serveBody(w http.ResponseWriter, r *http.Request, body []byte, modified time.Time) {
+	sum := sha256.Sum256(body)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	http.ServeContent(w, r, "", modified, bytes.NewReader(body))
 }
 
 // static serves static content.
 func (s *Server) static(w http.ResponseWriter, req request) {
-	http.ServeFile(w, req.r, filepath.Clean(filepath.Join(s.basedir, req.r.URL.Path)))
+	serveFile(w, req.r, s.settings().files, req.r.URL.Path)
 }
 
 // Root returns the root mount point of the server suitable for use as a path
@@ -235,8 +798,8 @@ func (s *Server) Root() string {
 	return s.root + "/"
 }
 
-func index(_ request, s *Server) (*page, error) {
-	major, minor, patch, extra, err := s.c.ServerVersion()
+func index(req request, s *Server) (*page, error) {
+	major, minor, patch, extra, err := req.id.c.ServerVersion()
 	if err != nil {
 		return nil, err
 	}
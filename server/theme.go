@@ -0,0 +1,109 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+// Theming and branding of the user interface.
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Branding customizes the appearance of the user interface. It's available
+// to the main template as .Site.
+type Branding struct {
+	// SiteName is used in page titles and names the link to HomeURL
+	// (default: "SysDB").
+	SiteName string
+
+	// HomeURL specifies the target of the link in the top menu (default:
+	// "https://sysdb.io").
+	HomeURL string
+
+	// Logo specifies the URL of the logo. Relative URLs refer to static
+	// files (default: "images/owl.png").
+	Logo string
+
+	// Links specifies additional navigation links.
+	Links []Link
+
+	// Banner is displayed on top of all pages and in all page titles, e.g.
+	// "PRODUCTION", to tell apart multiple instances of the user interface.
+	Banner string
+
+	// BannerColor specifies the CSS background color of the banner
+	// (default: "#c00").
+	BannerColor string
+}
+
+// A Link is a navigation link.
+type Link struct {
+	Title string
+	URL   string
+}
+
+// resolve applies default values and turns relative URLs into absolute
+// paths below the specified root.
+func (b Branding) resolve(root string) *Branding {
+	if b.SiteName == "" {
+		b.SiteName = "SysDB"
+	}
+	if b.HomeURL == "" {
+		b.HomeURL = "https://sysdb.io"
+	}
+	if b.Logo == "" {
+		b.Logo = "images/owl.png"
+	}
+	if b.BannerColor == "" {
+		b.BannerColor = "#c00"
+	}
+	if !strings.HasPrefix(b.Logo, "/") && !strings.Contains(b.Logo, "://") {
+		b.Logo = root + b.Logo
+	}
+	return &b
+}
+
+// themeDirs returns the template and static directories of a theme. A theme
+// does not have to provide both of them.
+func themeDirs(theme string) (templates, static string, err error) {
+	if theme == "" {
+		return "", "", nil
+	}
+	if _, err := os.Stat(theme); err != nil {
+		return "", "", err
+	}
+	sub := func(name string) string {
+		dir := filepath.Join(theme, name)
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			return dir
+		}
+		return ""
+	}
+	return sub("templates"), sub("static"), nil
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
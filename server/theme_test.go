@@ -0,0 +1,117 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBrandingResolve(t *testing.T) {
+	for _, test := range []struct {
+		b    Branding
+		want Branding
+	}{
+		{
+			b: Branding{},
+			want: Branding{
+				SiteName:    "SysDB",
+				HomeURL:     "https://sysdb.io",
+				Logo:        "/sysdb/images/owl.png",
+				BannerColor: "#c00",
+			},
+		},
+		{
+			b: Branding{
+				SiteName:    "SysDB (ops)",
+				HomeURL:     "https://wiki.example.com/",
+				Logo:        "images/ops.png",
+				Banner:      "PRODUCTION",
+				BannerColor: "green",
+			},
+			want: Branding{
+				SiteName:    "SysDB (ops)",
+				HomeURL:     "https://wiki.example.com/",
+				Logo:        "/sysdb/images/ops.png",
+				Banner:      "PRODUCTION",
+				BannerColor: "green",
+			},
+		},
+		{
+			b: Branding{Logo: "/logo.png"},
+			want: Branding{
+				SiteName:    "SysDB",
+				HomeURL:     "https://sysdb.io",
+				Logo:        "/logo.png",
+				BannerColor: "#c00",
+			},
+		},
+		{
+			b: Branding{Logo: "https://cdn.example.com/logo.png"},
+			want: Branding{
+				SiteName:    "SysDB",
+				HomeURL:     "https://sysdb.io",
+				Logo:        "https://cdn.example.com/logo.png",
+				BannerColor: "#c00",
+			},
+		},
+	} {
+		if got := test.b.resolve("/sysdb/"); !reflect.DeepEqual(*got, test.want) {
+			t.Errorf("%+v.resolve(/sysdb/) = %+v; want %+v", test.b, *got, test.want)
+		}
+	}
+}
+
+func TestThemeDirs(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "templates"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		theme             string
+		templates, static string
+		wantErr           bool
+	}{
+		{"", "", "", false},
+		{dir, filepath.Join(dir, "templates"), "", false},
+		{filepath.Join(dir, "missing"), "", "", true},
+	} {
+		templates, static, err := themeDirs(test.theme)
+		if (err != nil) != test.wantErr {
+			t.Errorf("themeDirs(%q) = %v; want error: %v", test.theme, err, test.wantErr)
+			continue
+		}
+		if templates != test.templates || static != test.static {
+			t.Errorf("themeDirs(%q) = %q, %q; want %q, %q",
+				test.theme, templates, static, test.templates, test.static)
+		}
+	}
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
@@ -0,0 +1,174 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+// Helper functions for serving the user interface using TLS.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimum interval between two checks for modified certificate files.
+const certCheckInterval = 5 * time.Second
+
+// A CertLoader provides a TLS certificate loaded from disk. The certificate
+// is reloaded automatically whenever the certificate or key file changes.
+type CertLoader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	mtime   time.Time
+	checked time.Time
+}
+
+// NewCertLoader loads the specified PEM encoded certificate and key files.
+func NewCertLoader(certFile, keyFile string) (*CertLoader, error) {
+	l := &CertLoader{certFile: certFile, keyFile: keyFile}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// modified returns the latest modification time of the certificate and key
+// files.
+func (l *CertLoader) modified() (time.Time, error) {
+	var mtime time.Time
+	for _, f := range []string{l.certFile, l.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(mtime) {
+			mtime = fi.ModTime()
+		}
+	}
+	return mtime, nil
+}
+
+func (l *CertLoader) load() error {
+	mtime, err := l.modified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return err
+	}
+	l.cert, l.mtime, l.checked = &cert, mtime, time.Now()
+	return nil
+}
+
+// GetCertificate returns the current certificate. It is suitable for use as
+// the GetCertificate callback of a tls.Config. Errors while reloading the
+// certificate are logged and the previous certificate remains in use.
+func (l *CertLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if time.Since(l.checked) < certCheckInterval {
+		return l.cert, nil
+	}
+	l.checked = time.Now()
+	if mtime, err := l.modified(); err != nil {
+		log.Printf("Failed to check TLS certificate: %v", err)
+	} else if mtime.After(l.mtime) {
+		if err := l.load(); err != nil {
+			log.Printf("Failed to reload TLS certificate: %v", err)
+		} else {
+			log.Printf("Reloaded TLS certificate %s.", l.certFile)
+		}
+	}
+	return l.cert, nil
+}
+
+// TLSConfig constructs a TLS configuration using the specified certificate
+// loader. If clientCA is not empty, client certificates are verified against
+// the CA certificates in that file. They are required if requireClientCert is
+// set and optional otherwise.
+func TLSConfig(l *CertLoader, clientCA string, requireClientCert bool) (*tls.Config, error) {
+	cfg := &tls.Config{
+		GetCertificate: l.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	if clientCA == "" {
+		if requireClientCert {
+			return nil, errors.New("client certificates require a CA")
+		}
+		return cfg, nil
+	}
+
+	pem, err := os.ReadFile(clientCA)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ClientCAs = x509.NewCertPool()
+	if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", clientCA)
+	}
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	if requireClientCert {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// RedirectHTTPS returns a handler which redirects all requests to the HTTPS
+// server listening on the specified address.
+func RedirectHTTPS(addr string) http.Handler {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil || port == "443" || port == "https" {
+		port = ""
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		if port != "" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
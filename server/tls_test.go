@@ -0,0 +1,183 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate and its key for the specified
+// common name.
+func writeCert(t *testing.T, certFile, keyFile, cn string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertLoader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, certFile, keyFile, "one")
+
+	l, err := NewCertLoader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewCertLoader() = %v; want <nil>", err)
+	}
+	touch := func(d time.Duration) {
+		mtime := time.Now().Add(d)
+		for _, f := range []string{certFile, keyFile} {
+			if err := os.Chtimes(f, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, test := range []struct {
+		update  func()
+		recheck bool
+		want    string
+	}{
+		{nil, false, "one"},
+		// Changes are not noticed before the check interval has passed.
+		{func() { writeCert(t, certFile, keyFile, "two"); touch(time.Minute) }, false, "one"},
+		{nil, true, "two"},
+		// Invalid files keep the previous certificate in use.
+		{func() { os.WriteFile(keyFile, []byte("garbage"), 0600); touch(2 * time.Minute) }, true, "two"},
+		{func() { os.Remove(certFile) }, true, "two"},
+		{func() { writeCert(t, certFile, keyFile, "three"); touch(3 * time.Minute) }, true, "three"},
+	} {
+		if test.update != nil {
+			test.update()
+		}
+		if test.recheck {
+			l.mu.Lock()
+			l.checked = time.Time{}
+			l.mu.Unlock()
+		}
+		cert, err := l.GetCertificate(nil)
+		if err != nil {
+			t.Fatalf("GetCertificate() = %v; want <nil>", err)
+		}
+		c, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Subject.CommonName != test.want {
+			t.Errorf("GetCertificate() = %s; want %s", c.Subject.CommonName, test.want)
+		}
+	}
+
+	if _, err := NewCertLoader(filepath.Join(dir, "missing.pem"), keyFile); err == nil {
+		t.Errorf("NewCertLoader(missing.pem) = <nil>; want error")
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, certFile, keyFile, "ca")
+	l, err := NewCertLoader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		clientCA string
+		require  bool
+		wantErr  bool
+	}{
+		{"", false, false},
+		{"", true, true},
+		{certFile, false, false},
+		{certFile, true, false},
+		{keyFile, false, true},
+		{filepath.Join(dir, "missing.pem"), false, true},
+	} {
+		if _, err := TLSConfig(l, test.clientCA, test.require); (err != nil) != test.wantErr {
+			t.Errorf("TLSConfig(%q, %v) = %v; want error: %v", test.clientCA, test.require, err, test.wantErr)
+		}
+	}
+}
+
+func TestRedirectHTTPS(t *testing.T) {
+	for _, test := range []struct {
+		addr, host, uri string
+		want            string
+	}{
+		{":443", "example.com", "/hosts?query=a", "https://example.com/hosts?query=a"},
+		{":443", "example.com:80", "/", "https://example.com/"},
+		{":8443", "example.com:8080", "/host/a", "https://example.com:8443/host/a"},
+		{"", "example.com", "/", "https://example.com/"},
+		{":https", "[::1]:80", "/", "https://[::1]/"},
+		{":8443", "[::1]:80", "/", "https://[::1]:8443/"},
+	} {
+		r := httptest.NewRequest("GET", test.uri, nil)
+		r.Host = test.host
+		w := httptest.NewRecorder()
+		RedirectHTTPS(test.addr).ServeHTTP(w, r)
+		if got := w.Header().Get("Location"); w.Code != http.StatusMovedPermanently || got != test.want {
+			t.Errorf("RedirectHTTPS(%q) for %s%s = %d %s; want 301 %s",
+				test.addr, test.host, test.uri, w.Code, got, test.want)
+		}
+	}
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
@@ -0,0 +1,295 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+// Helper functions for rendering the topology of hosts.
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Maximum number of related hosts per attribute.
+const maxRelated = 25
+
+// A topology describes a host along with its services, metrics, and related
+// hosts.
+type topology struct {
+	Host              string
+	Services, Metrics []string
+	Related           []relation
+
+	// Truncated is set if not all related hosts are included.
+	Truncated bool
+
+	// Attributes used to determine related hosts.
+	attrs []string
+}
+
+// A relation links a host to the topology's host through one or more shared
+// attribute values.
+type relation struct {
+	Host string
+
+	// Shared attributes formatted as "name = value".
+	Shared []string
+}
+
+// label returns a description of the shared attributes.
+func (r relation) label() string {
+	return strings.Join(r.Shared, ", ")
+}
+
+func topologyPage(req request, s *Server) (*page, error) {
+	related := req.r.FormValue("related")
+	t, err := req.id.topology(req.params.get("host"), formList(req.r.Form, "related"))
+	if err != nil {
+		return nil, err
+	}
+
+	p := struct {
+		*topology
+		Attributes string
+		SVG        template.HTML
+	}{
+		topology:   t,
+		Attributes: related,
+		SVG:        t.svg(req.inst.base),
+	}
+	return tmpl(s.result(req.inst, "topology"), &p)
+}
+
+// topologyDOT serves the topology of a host in Graphviz DOT format.
+func (s *Server) topologyDOT(w http.ResponseWriter, req request) {
+	req.r.ParseForm()
+	t, err := req.id.topology(req.params.get("host"), formList(req.r.Form, "related"))
+	if err != nil {
+		s.badrequest(w, err)
+		return
+	}
+
+	var buf bytes.Buffer
+	t.dot(&buf, req.inst.base)
+	w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=%q", t.Host+".dot"))
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, &buf)
+}
+
+// topology determines the topology of the specified host. Other hosts are
+// considered related if they share the value of any of the specified
+// attributes.
+func (id *identity) topology(name string, attrs []string) (*topology, error) {
+	host, err := id.fetchHost(name)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &topology{Host: host.Name, attrs: attrs}
+	for _, svc := range host.Services {
+		t.Services = append(t.Services, svc.Name)
+	}
+	for _, m := range host.Metrics {
+		t.Metrics = append(t.Metrics, m.Name)
+	}
+
+	// Index of related hosts in t.Related by name.
+	related := make(map[string]int)
+	values := attributes(*host)
+	for _, a := range attrs {
+		v, ok := values[a]
+		if !ok {
+			continue
+		}
+		q := &query{args: make(map[string]string)}
+		if err := q.attr("", a, v); err != nil {
+			return nil, err
+		}
+		hosts, err := id.lookupHostsMatching(q)
+		if err != nil {
+			return nil, err
+		}
+
+		n := 0
+		for _, h := range hosts {
+			if h.Name == host.Name {
+				continue
+			}
+			if n >= maxRelated {
+				t.Truncated = true
+				break
+			}
+			shared := a + " = " + v
+			if i, ok := related[h.Name]; ok {
+				t.Related[i].Shared = append(t.Related[i].Shared, shared)
+			} else {
+				related[h.Name] = len(t.Related)
+				t.Related = append(t.Related, relation{Host: h.Name, Shared: []string{shared}})
+			}
+			n++
+		}
+	}
+	return t, nil
+}
+
+// Layout parameters of the SVG rendering (in pixels).
+const (
+	nodeWidth  = 200
+	nodeHeight = 20
+	colSpacing = 80
+	rowSpacing = 8
+	margin     = 10
+	maxLabel   = 28
+)
+
+// svg renders the topology as an inline SVG image. Services are placed to the
+// left of the host, metrics to its right, and related hosts below. All nodes
+// link to the respective pages of the user interface.
+func (t *topology) svg(root string) template.HTML {
+	var buf bytes.Buffer
+	row := nodeHeight + rowSpacing
+	col := nodeWidth + colSpacing
+	x := []int{margin, margin + col, margin + 2*col}
+	width := 2*margin + 3*nodeWidth + 2*colSpacing
+
+	rows := len(t.Services)
+	if len(t.Metrics) > rows {
+		rows = len(t.Metrics)
+	}
+	if rows == 0 {
+		rows = 1
+	}
+	hostY := margin + (rows*row-rowSpacing)/2 - nodeHeight/2
+	relY := margin + rows*row + 2*row
+	relRows := (len(t.Related) + 2) / 3
+	height := relY + relRows*(row+nodeHeight) + margin
+	if len(t.Related) == 0 {
+		height = margin + rows*row - rowSpacing + margin
+	}
+
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" `+
+		`xmlns:xlink="http://www.w3.org/1999/xlink" class="topology" `+
+		`width="%d" height="%d" viewBox="0 0 %d %d">`+"\n", width, height, width, height)
+
+	hostURL := root + "host/" + url.PathEscape(t.Host)
+	related := url.Values{"related": {strings.Join(t.attrs, ",")}}.Encode()
+	for i, name := range t.Services {
+		y := margin + i*row
+		svgEdge(&buf, x[1], hostY+nodeHeight/2, x[0]+nodeWidth, y+nodeHeight/2, "edge")
+		svgNode(&buf, x[0], y, nodeHeight, "service", name, "",
+			root+"service/"+url.PathEscape(t.Host)+"/"+url.PathEscape(name))
+	}
+	for i, name := range t.Metrics {
+		y := margin + i*row
+		svgEdge(&buf, x[1]+nodeWidth, hostY+nodeHeight/2, x[2], y+nodeHeight/2, "edge")
+		svgNode(&buf, x[2], y, nodeHeight, "metric", name, "",
+			root+"metric/"+url.PathEscape(t.Host)+"/"+url.PathEscape(name))
+	}
+	for i, r := range t.Related {
+		nx, ny := x[i%3], relY+(i/3)*(row+nodeHeight)
+		svgEdge(&buf, x[1]+nodeWidth/2, hostY+nodeHeight, nx+nodeWidth/2, ny, "edge related")
+		svgNode(&buf, nx, ny, 2*nodeHeight, "related", r.Host, r.label(),
+			root+"topology/"+url.PathEscape(r.Host)+"?"+related)
+	}
+	svgNode(&buf, x[1], hostY, nodeHeight, "host", t.Host, "", hostURL)
+
+	buf.WriteString("</svg>\n")
+	return template.HTML(buf.String())
+}
+
+func svgEdge(w io.Writer, x1, y1, x2, y2 int, class string) {
+	fmt.Fprintf(w, `<line class="%s" x1="%d" y1="%d" x2="%d" y2="%d" />`+"\n",
+		class, x1, y1, x2, y2)
+}
+
+func svgNode(w io.Writer, x, y, height int, class, label, sublabel, href string) {
+	fmt.Fprintf(w, `<a xlink:href="%s"><g class="node %s">`+
+		`<title>%s</title>`+
+		`<rect x="%d" y="%d" width="%d" height="%d" rx="3" ry="3" />`+
+		`<text x="%d" y="%d">%s</text>`,
+		template.HTMLEscapeString(href), class, template.HTMLEscapeString(label),
+		x, y, nodeWidth, height,
+		x+5, y+nodeHeight-6, template.HTMLEscapeString(truncate(label, maxLabel)))
+	if sublabel != "" {
+		fmt.Fprintf(w, `<text class="sublabel" x="%d" y="%d">%s</text>`,
+			x+5, y+2*nodeHeight-6, template.HTMLEscapeString(truncate(sublabel, maxLabel)))
+	}
+	fmt.Fprintln(w, "</g></a>")
+}
+
+// truncate shortens s to at most n characters.
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func dotID(s string) string {
+	return `"` + dotEscaper.Replace(s) + `"`
+}
+
+// dot writes the topology in Graphviz DOT format.
+func (t *topology) dot(w io.Writer, root string) {
+	host := dotID("host:" + t.Host)
+	fmt.Fprintf(w, "digraph %s {\n", dotID(t.Host))
+	fmt.Fprintln(w, "\trankdir=LR;")
+	fmt.Fprintln(w, "\tnode [shape=box];")
+	fmt.Fprintf(w, "\t%s [label=%s, style=bold, URL=%s];\n", host,
+		dotID(t.Host), dotID(root+"host/"+url.PathEscape(t.Host)))
+
+	for _, name := range t.Services {
+		id := dotID("service:" + name)
+		fmt.Fprintf(w, "\t%s [label=%s, shape=ellipse, URL=%s];\n", id, dotID(name),
+			dotID(root+"service/"+url.PathEscape(t.Host)+"/"+url.PathEscape(name)))
+		fmt.Fprintf(w, "\t%s -> %s;\n", host, id)
+	}
+	for _, name := range t.Metrics {
+		id := dotID("metric:" + name)
+		fmt.Fprintf(w, "\t%s [label=%s, shape=note, URL=%s];\n", id, dotID(name),
+			dotID(root+"metric/"+url.PathEscape(t.Host)+"/"+url.PathEscape(name)))
+		fmt.Fprintf(w, "\t%s -> %s;\n", host, id)
+	}
+	for _, r := range t.Related {
+		id := dotID("host:" + r.Host)
+		fmt.Fprintf(w, "\t%s [label=%s, URL=%s];\n", id, dotID(r.Host),
+			dotID(root+"host/"+url.PathEscape(r.Host)))
+		fmt.Fprintf(w, "\t%s -> %s [label=%s, style=dashed, dir=none];\n",
+			host, id, dotID(r.label()))
+	}
+	fmt.Fprintln(w, "}")
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
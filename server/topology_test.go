@@ -0,0 +1,131 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package server
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sysdb/go/sysdb"
+)
+
+func TestTopologyDOT(t *testing.T) {
+	for _, test := range []struct {
+		t    *topology
+		want []string
+	}{
+		{
+			t: &topology{Host: "a"},
+			want: []string{
+				`digraph "a" {`,
+				"\trankdir=LR;",
+				"\tnode [shape=box];",
+				`	"host:a" [label="a", style=bold, URL="/sysdb/host/a"];`,
+				"}",
+			},
+		},
+		{
+			t: &topology{
+				Host:     "web 1",
+				Services: []string{"http"},
+				Metrics:  []string{"cpu/load"},
+				Related:  []relation{{Host: "db1", Shared: []string{`dc = eu "west"`}}},
+			},
+			want: []string{
+				`digraph "web 1" {`,
+				"\trankdir=LR;",
+				"\tnode [shape=box];",
+				`	"host:web 1" [label="web 1", style=bold, URL="/sysdb/host/web%201"];`,
+				`	"service:http" [label="http", shape=ellipse, URL="/sysdb/service/web%201/http"];`,
+				`	"host:web 1" -> "service:http";`,
+				`	"metric:cpu/load" [label="cpu/load", shape=note, URL="/sysdb/metric/web%201/cpu%2Fload"];`,
+				`	"host:web 1" -> "metric:cpu/load";`,
+				`	"host:db1" [label="db1", URL="/sysdb/host/db1"];`,
+				`	"host:web 1" -> "host:db1" [label="dc = eu \"west\"", style=dashed, dir=none];`,
+				"}",
+			},
+		},
+	} {
+		var buf bytes.Buffer
+		test.t.dot(&buf, "/sysdb/")
+		if got, want := buf.String(), strings.Join(test.want, "\n")+"\n"; got != want {
+			t.Errorf("dot(%s) =\n%s\nwant:\n%s", test.t.Host, got, want)
+		}
+	}
+}
+
+func TestTopology(t *testing.T) {
+	attrs := []sysdb.Attribute{{Name: "dc", Value: "eu"}, {Name: "rack", Value: "r1"}}
+	b := &fakeBackend{res: map[string]interface{}{
+		"FETCH host 'web1'": &sysdb.Host{Name: "web1", Attributes: attrs},
+		"LOOKUP hosts MATCHING attribute['dc'] = 'eu'": []sysdb.Host{
+			{Name: "web1"}, {Name: "db1"}, {Name: "db2"},
+		},
+		"LOOKUP hosts MATCHING attribute['rack'] = 'r1'": []sysdb.Host{
+			{Name: "web1"}, {Name: "db1"},
+		},
+	}}
+	id := &identity{c: b}
+
+	top, err := id.topology("web1", []string{"dc", "rack"})
+	if err != nil {
+		t.Fatalf("topology(web1) = %v; want <nil>", err)
+	}
+	want := []relation{
+		{Host: "db1", Shared: []string{"dc = eu", "rack = r1"}},
+		{Host: "db2", Shared: []string{"dc = eu"}},
+	}
+	if !reflect.DeepEqual(top.Related, want) {
+		t.Errorf("topology(web1).Related = %v; want %v", top.Related, want)
+	}
+
+	svg := string(top.svg("/sysdb/"))
+	if link := `href="/sysdb/topology/db1?related=dc%2Crack"`; !strings.Contains(svg, link) {
+		t.Errorf("svg() does not link to related hosts using %s:\n%s", link, svg)
+	}
+	if n := strings.Count(svg, "<title>db1</title>"); n != 1 {
+		t.Errorf("svg() includes %d nodes for db1; want 1", n)
+	}
+}
+
+func TestDotID(t *testing.T) {
+	for _, test := range []struct {
+		s, want string
+	}{
+		{"a", `"a"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`C:\dir`, `"C:\\dir"`},
+		{"two\nlines", `"two\nlines"`},
+	} {
+		if got := dotID(test.s); got != test.want {
+			t.Errorf("dotID(%q) = %s; want %s", test.s, got, test.want)
+		}
+	}
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
@@ -0,0 +1,253 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+// Support for configuration files in TOML format.
+//
+// Options are flat key/value pairs, so only the corresponding subset of TOML
+// (see https://toml.io/) is supported: bare or quoted keys, basic and literal
+// strings, integers, floats, booleans, and arrays of strings. Tables,
+// multi-line strings, and dates are rejected.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A tomlError describes a syntax error at the specified offset.
+type tomlError struct {
+	offset int
+	msg    string
+}
+
+func (e *tomlError) Error() string {
+	return e.msg
+}
+
+type tomlParser struct {
+	data []byte
+	pos  int
+}
+
+// parseTOML parses a TOML document and returns the command line
+// representation of all values. Arrays are turned into comma-separated
+// values.
+func parseTOML(data []byte) (map[string]string, error) {
+	p := &tomlParser{data: data}
+	values := make(map[string]string)
+	for {
+		p.skipSpace(true)
+		if p.eof() {
+			return values, nil
+		}
+		if p.peek() == '[' {
+			return nil, p.errorf("tables are not supported")
+		}
+
+		start := p.pos
+		key, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := values[key]; ok {
+			p.pos = start
+			return nil, p.errorf("duplicate key %q", key)
+		}
+		p.skipSpace(false)
+		if p.eof() || p.peek() != '=' {
+			return nil, p.errorf("expected '=' after key %q", key)
+		}
+		p.pos++
+		p.skipSpace(false)
+		if values[key], err = p.value(); err != nil {
+			return nil, err
+		}
+		p.skipSpace(false)
+		if !p.eof() && p.peek() != '\n' && p.peek() != '\r' {
+			return nil, p.errorf("expected newline after value of %q", key)
+		}
+	}
+}
+
+func (p *tomlParser) eof() bool {
+	return p.pos >= len(p.data)
+}
+
+func (p *tomlParser) peek() byte {
+	return p.data[p.pos]
+}
+
+func (p *tomlParser) errorf(format string, a ...interface{}) error {
+	return &tomlError{offset: p.pos, msg: fmt.Sprintf(format, a...)}
+}
+
+// skipSpace skips whitespace and comments, including newlines if requested.
+func (p *tomlParser) skipSpace(newlines bool) {
+	for !p.eof() {
+		switch c := p.peek(); {
+		case c == ' ' || c == '\t':
+			p.pos++
+		case newlines && (c == '\n' || c == '\r'):
+			p.pos++
+		case c == '#':
+			for !p.eof() && p.peek() != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *tomlParser) key() (string, error) {
+	if c := p.peek(); c == '"' || c == '\'' {
+		return p.str()
+	}
+	start := p.pos
+	for !p.eof() {
+		c := p.peek()
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			break
+		}
+		p.pos++
+	}
+	if p.pos == start {
+		return "", p.errorf("expected key")
+	}
+	if !p.eof() && p.peek() == '.' {
+		return "", p.errorf("dotted keys are not supported")
+	}
+	return string(p.data[start:p.pos]), nil
+}
+
+// str parses a single-line basic or literal string.
+func (p *tomlParser) str() (string, error) {
+	quote := p.peek()
+	start := p.pos
+	if strings.HasPrefix(string(p.data[p.pos:]), strings.Repeat(string(quote), 3)) {
+		return "", p.errorf("multi-line strings are not supported")
+	}
+	for p.pos++; !p.eof(); p.pos++ {
+		switch c := p.peek(); {
+		case c == '\n':
+			p.pos = start
+			return "", p.errorf("unterminated string")
+		case c == '\\' && quote == '"':
+			p.pos++
+		case c == quote:
+			p.pos++
+			s := string(p.data[start:p.pos])
+			if quote == '\'' {
+				return s[1 : len(s)-1], nil
+			}
+			v, err := strconv.Unquote(s)
+			if err != nil {
+				p.pos = start
+				return "", p.errorf("invalid string %s", s)
+			}
+			return v, nil
+		}
+	}
+	p.pos = start
+	return "", p.errorf("unterminated string")
+}
+
+func (p *tomlParser) value() (string, error) {
+	if p.eof() {
+		return "", p.errorf("expected value")
+	}
+	switch p.peek() {
+	case '"', '\'':
+		return p.str()
+	case '[':
+		return p.array()
+	case '{':
+		return "", p.errorf("inline tables are not supported")
+	}
+
+	start := p.pos
+	for !p.eof() && !strings.ContainsRune(" \t\r\n#,]", rune(p.peek())) {
+		p.pos++
+	}
+	v := string(p.data[start:p.pos])
+	switch {
+	case v == "true" || v == "false":
+		return v, nil
+	case strings.HasPrefix(v, "0x") || strings.HasPrefix(v, "0o") || strings.HasPrefix(v, "0b"):
+		if i, err := strconv.ParseInt(v, 0, 64); err == nil {
+			return strconv.FormatInt(i, 10), nil
+		}
+	default:
+		d := strings.Replace(v, "_", "", -1)
+		if _, err := strconv.ParseInt(d, 10, 64); err == nil {
+			return strings.TrimPrefix(d, "+"), nil
+		}
+		if _, err := strconv.ParseFloat(d, 64); err == nil && !strings.ContainsAny(d, "xXpP") {
+			return strings.TrimPrefix(d, "+"), nil
+		}
+	}
+	p.pos = start
+	return "", p.errorf("invalid value %q: expected string, number, boolean, or array", v)
+}
+
+// array parses an array of strings, which may span multiple lines.
+func (p *tomlParser) array() (string, error) {
+	var list []string
+	p.pos++
+	for {
+		p.skipSpace(true)
+		if p.eof() {
+			return "", p.errorf("unterminated array")
+		}
+		if p.peek() == ']' {
+			p.pos++
+			return strings.Join(list, ","), nil
+		}
+		if c := p.peek(); c != '"' && c != '\'' {
+			return "", p.errorf("expected array of strings")
+		}
+		s, err := p.str()
+		if err != nil {
+			return "", err
+		}
+		list = append(list, s)
+
+		p.skipSpace(true)
+		if p.eof() {
+			return "", p.errorf("unterminated array")
+		}
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+		default:
+			return "", p.errorf("expected ',' or ']' in array")
+		}
+	}
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :
@@ -0,0 +1,96 @@
+//
+// Copyright (C) 2014 Sebastian 'tokkee' Harl <sh@tokkee.org>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+// PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDERS OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	for _, test := range []struct {
+		data string
+		want map[string]string
+		err  string
+	}{
+		{"", map[string]string{}, ""},
+		{
+			data: "# comment\n\nlisten = \":8080\" # trailing comment\r\n" +
+				"\"site-name\" = 'C:\\sysdb'\n" +
+				"banner = \"say \\\"hi\\\"\\n\"\n" +
+				"dev = true\n" +
+				"cache-size = 1_000\n" +
+				"listen-mode = 0o660\n" +
+				"rate-limit = +0.5\n" +
+				"auth-proxies = [\n\t\"10.0.0.0/8\", # office\n\t'::1/128',\n]\n" +
+				"admins = []",
+			want: map[string]string{
+				"listen":       ":8080",
+				"site-name":    `C:\sysdb`,
+				"banner":       "say \"hi\"\n",
+				"dev":          "true",
+				"cache-size":   "1000",
+				"listen-mode":  "432",
+				"rate-limit":   "0.5",
+				"auth-proxies": "10.0.0.0/8,::1/128",
+				"admins":       "",
+			},
+		},
+		{data: "[server]\nlisten = \":8080\"", err: "1:1: tables are not supported"},
+		{data: "listen = \":8080\"\nlisten = \":9090\"", err: `2:1: duplicate key "listen"`},
+		{data: "listen \":8080\"", err: `1:8: expected '=' after key "listen"`},
+		{data: "listen = :8080", err: `1:10: invalid value ":8080"`},
+		{data: "listen = \":8080", err: "1:10: unterminated string"},
+		{data: "listen = \":8080\nbanner = \"x\"", err: "1:10: unterminated string"},
+		{data: "banner = \"\"\"\nx\"\"\"", err: "1:10: multi-line strings are not supported"},
+		{data: "listen = \":8080\" \":9090\"", err: `1:18: expected newline after value of "listen"`},
+		{data: "snapshot-interval = 1979-05-27", err: "1:21: invalid value"},
+		{data: "auth-proxies = [1, 2]", err: "1:17: expected array of strings"},
+		{data: "auth-proxies = [\"a\" \"b\"]", err: "1:21: expected ',' or ']' in array"},
+		{data: "tls.cert = \"cert.pem\"", err: "1:4: dotted keys are not supported"},
+		{data: "headers = { a = \"b\" }", err: "1:11: inline tables are not supported"},
+	} {
+		got, err := parseTOML([]byte(test.data))
+		if test.err != "" {
+			if err == nil {
+				t.Errorf("parseTOML(%q) = %v; want error containing %q", test.data, got, test.err)
+				continue
+			}
+			line, col := position([]byte(test.data), int64(err.(*tomlError).offset)+1)
+			if msg := fmt.Sprintf("%d:%d: %v", line, col, err); !strings.Contains(msg, test.err) {
+				t.Errorf("parseTOML(%q) = %s; want error containing %q", test.data, msg, test.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseTOML(%q) = %v, %v; want %v", test.data, got, err, test.want)
+		}
+	}
+}
+
+// vim: set tw=78 sw=4 sw=4 noexpandtab :